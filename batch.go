@@ -0,0 +1,179 @@
+package portal
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/fatih/structs"
+	"github.com/pkg/errors"
+)
+
+// BatchCacher is an optional interface of Cacher for remote stores, which
+// saves round trips when dumping many objects. If implemented, portal gets
+// the keys of all objects with one GetMulti call before resolving them, and
+// sets the results with SetMulti calls after.
+type BatchCacher interface {
+	// GetMulti returns the values of found keys, missing keys are absent in the result.
+	GetMulti(ctx context.Context, keys []interface{}) (map[interface{}]interface{}, error)
+	// SetMulti sets the items with a ttl, the items never expire if ttl is not positive.
+	SetMulti(ctx context.Context, items map[interface{}]interface{}, ttl time.Duration) error
+}
+
+var cacheBatchCtxKey = contextKey{name: "cache-batch"}
+
+// cacheBatch holds values prefetched from a BatchCacher and
+// values to be set when dumping many objects.
+type cacheBatch struct {
+	cache BatchCacher
+
+	mu      sync.Mutex
+	values  map[string]interface{}
+	fetched map[string]bool
+	pending map[time.Duration]map[interface{}]interface{}
+}
+
+func newCacheBatch(cache BatchCacher) *cacheBatch {
+	return &cacheBatch{
+		cache:   cache,
+		values:  make(map[string]interface{}),
+		fetched: make(map[string]bool),
+		pending: make(map[time.Duration]map[interface{}]interface{}),
+	}
+}
+
+func withCacheBatch(ctx context.Context, b *cacheBatch) context.Context {
+	return context.WithValue(ctx, cacheBatchCtxKey, b)
+}
+
+func cacheBatchFromContext(ctx context.Context) *cacheBatch {
+	b, _ := ctx.Value(cacheBatchCtxKey).(*cacheBatch)
+	return b
+}
+
+func (b *cacheBatch) prefetch(ctx context.Context, keys []interface{}) {
+	values, err := b.cache.GetMulti(ctx, keys)
+	if err != nil {
+		logger.Warnf("[portal.cache] failed to get %d keys: %s", len(keys), err)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, key := range keys {
+		b.fetched[key.(string)] = true
+	}
+	for key, value := range values {
+		if k, ok := key.(string); ok {
+			b.values[k] = value
+		}
+	}
+}
+
+// get returns the value of key, known is false if the key
+// is not fetched, then it should be got from the cache.
+func (b *cacheBatch) get(key string) (value interface{}, ok, known bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if value, ok = b.values[key]; ok {
+		return value, true, true
+	}
+	return nil, false, b.fetched[key]
+}
+
+func (b *cacheBatch) set(key string, value interface{}, ttl time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.values[key] = value
+	items, ok := b.pending[ttl]
+	if !ok {
+		items = make(map[interface{}]interface{})
+		b.pending[ttl] = items
+	}
+	items[key] = value
+}
+
+// flush sets the pending values, grouped by ttl.
+func (b *cacheBatch) flush(ctx context.Context) error {
+	b.mu.Lock()
+	pending := b.pending
+	b.pending = make(map[time.Duration]map[interface{}]interface{})
+	b.mu.Unlock()
+
+	for ttl, items := range pending {
+		if err := b.cache.SetMulti(ctx, items, ttl); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// prefetch gets values of all objects in src from the configured cache, if it
+// implements BatchCacher. Only keys of the first method of each field are known
+// before resolving, e.g. `GetProfile` of `meth:GetProfile.Name`.
+func (c *Chell) prefetch(ctx context.Context, schemaType reflect.Type, src reflect.Value, sel *fieldSelection) (context.Context, *cacheBatch) {
+	if c.disableCache || src.Len() == 0 {
+		return ctx, nil
+	}
+
+	cache, ok := sharedCache(ctx).(BatchCacher)
+	if !ok {
+		return ctx, nil
+	}
+
+	tmpl := c.newSchema(ctx, reflect.New(schemaType).Interface())
+	tmpl.selectFields(sel)
+	c.applyCustomFieldTags(tmpl)
+
+	var keys []interface{}
+	seen := make(map[string]bool)
+	for _, field := range tmpl.availableFields() {
+		cacheOpt := field.cacheOption(c.disableCache)
+		if field.hasConstValue() || cacheOpt == nil {
+			continue
+		}
+
+		for i := 0; i < src.Len(); i++ {
+			ck := firstCacheKey(ctx, tmpl, field, src.Index(i).Interface(), cacheOpt)
+			if ck == nil || !ck.stable || seen[ck.key] {
+				continue
+			}
+			seen[ck.key] = true
+			keys = append(keys, ck.sharedKey())
+		}
+	}
+
+	b := newCacheBatch(cache)
+	if len(keys) > 0 {
+		b.prefetch(ctx, keys)
+	}
+	return withCacheBatch(ctx, b), b
+}
+
+// firstCacheKey returns the key of the first cached method of the field, or nil
+// if the field is not cached.
+func firstCacheKey(ctx context.Context, s *schema, field *schemaField, v interface{}, cacheOpt *cacheOption) *cacheKey {
+	if isNil(v) || !structs.IsStruct(v) {
+		return nil
+	}
+
+	if field.hasMethod() {
+		m, _ := field.method()
+		if m == "" {
+			return nil
+		}
+		return genCacheKey(ctx, s.rawValue, v, m, cacheOpt)
+	}
+
+	if field.hasChainingAttrs() {
+		attr := field.chainingAttrs()[0]
+		if _, err := findMethod(reflect.ValueOf(v), attr); err != nil {
+			return nil
+		}
+		return genCacheKey(ctx, v, v, attr, cacheOpt)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package portal
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingStore counts calls to the remote store.
+type countingStore struct {
+	ByteStore
+	gets, getMultis, sets, setMultis int32
+}
+
+func newCountingStore() *countingStore {
+	return &countingStore{ByteStore: *NewByteStore()}
+}
+
+func (s *countingStore) Get(ctx context.Context, key interface{}) (interface{}, error) {
+	atomic.AddInt32(&s.gets, 1)
+	return s.ByteStore.Get(ctx, key)
+}
+
+func (s *countingStore) GetMulti(ctx context.Context, keys []interface{}) (map[interface{}]interface{}, error) {
+	atomic.AddInt32(&s.getMultis, 1)
+	return s.ByteStore.GetMulti(ctx, keys)
+}
+
+func (s *countingStore) SetWithTTL(ctx context.Context, key, value interface{}, ttl time.Duration) error {
+	atomic.AddInt32(&s.sets, 1)
+	return s.ByteStore.SetWithTTL(ctx, key, value, ttl)
+}
+
+func (s *countingStore) SetMulti(ctx context.Context, items map[interface{}]interface{}, ttl time.Duration) error {
+	atomic.AddInt32(&s.setMultis, 1)
+	return s.ByteStore.SetMulti(ctx, items, ttl)
+}
+
+type BatchSchema struct {
+	Name  string `portal:"meth:GetName"`
+	Title string `portal:"meth:GetTitle;cachettl:1m;async"`
+	// an attribute chain, only the first method is prefetched
+	FullName string `portal:"attr:Profile.FullName"`
+}
+
+func (s *BatchSchema) GetName(m *IdentifiedModel) string {
+	return "name"
+}
+
+func (s *BatchSchema) GetTitle(m *IdentifiedModel) string {
+	return "title"
+}
+
+func TestDumpMany_BatchCacher(t *testing.T) {
+	RegisterCacheType(&Student{})
+	remote := newCountingStore()
+	models := []*IdentifiedModel{{ID: 1}, {ID: 2}, {ID: 3}, {ID: 1}}
+
+	for _, disableConcurrency := range []bool{true, false} {
+		remote.ByteStore = *NewByteStore()
+		remote.gets, remote.getMultis, remote.sets, remote.setMultis = 0, 0, 0, 0
+
+		opts := []option{UseCache(NewTieredCache(newMapCache(), remote, GobCodec))}
+		if disableConcurrency {
+			opts = append(opts, DisableConcurrency())
+		}
+		var dst []BatchSchema
+		require.Nil(t, Dump(&dst, models, opts...))
+		assert.Len(t, dst, 4)
+		assert.Equal(t, BatchSchema{Name: "name", Title: "title", FullName: "Harry Potter"}, dst[3])
+		assert.Equal(t, int32(1), remote.getMultis)
+		// the second methods of attribute chains
+		assert.Equal(t, int32(3), remote.gets)
+		// grouped by ttl
+		assert.Equal(t, int32(2), remote.setMultis)
+		assert.Equal(t, int32(0), remote.sets)
+		assert.Equal(t, 12, remote.Len())
+
+		// another replica
+		opts[0] = UseCache(NewTieredCache(newMapCache(), remote, GobCodec))
+		dst = nil
+		require.Nil(t, Dump(&dst, models, opts...))
+		assert.Equal(t, BatchSchema{Name: "name", Title: "title", FullName: "Harry Potter"}, dst[0])
+		assert.Equal(t, int32(2), remote.getMultis)
+		assert.Equal(t, int32(6), remote.gets)
+		assert.Equal(t, int32(2), remote.setMultis)
+	}
+}
+
+func TestDumpMany_PlainCacher(t *testing.T) {
+	cache := &setGetOnlyCache{}
+	models := []*IdentifiedModel{{ID: 1}, {ID: 2}}
+
+	var dst []BatchSchema
+	require.Nil(t, Dump(&dst, models, UseCache(cache)))
+	assert.Equal(t, 8, cache.m.Len())
+	require.Nil(t, Dump(&dst, models, UseCache(cache)))
+	assert.Equal(t, "name", dst[1].Name)
+}
@@ -3,55 +3,201 @@ package portal
 import (
 	"context"
 	"fmt"
+	"reflect"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/pkg/errors"
 	"golang.org/x/sync/singleflight"
 )
 
+// Cacher is the backing store of cached `attr` and `meth` field values.
+// Implementations must be safe for concurrent use, Get must return *ErrNil
+// if the key is not found or expired, and a value set must be returned by Get
+// until it's evicted. Keys are strings namespaced by the package and name of the
+// schema or model, e.g. `portal:github.com/foo/bar.UserSchema#GetName#UserModel:42`.
+// Run `cachetest.Run` against custom implementations to verify the contract.
 type Cacher interface {
 	Set(ctx context.Context, key interface{}, value interface{}) error
 	Get(ctx context.Context, key interface{}) (interface{}, error)
 }
 
+// TTLSetter is an optional interface of Cacher. If implemented,
+// portal calls SetWithTTL instead of Set for fields with a TTL,
+// e.g. tagged with `cachettl:30s`.
+type TTLSetter interface {
+	SetWithTTL(ctx context.Context, key interface{}, value interface{}, ttl time.Duration) error
+}
+
+// Deleter is an optional interface of Cacher, which is required
+// to invalidate cached values, see Invalidate.
+type Deleter interface {
+	Delete(ctx context.Context, keys ...interface{}) error
+}
+
 type ErrNil struct{}
 
 func (e *ErrNil) Error() string {
 	return "portal cache key not found."
 }
 
+// MapCache is an in-memory Cacher backed by sync.Map.
+// Entries expire lazily on access, and also periodically
+// if it's created with a cleanup interval.
 type MapCache struct {
 	c sync.Map
+	// mu serializes writes, so an expired entry is only removed
+	// if it's not replaced by a fresh one.
+	mu         sync.Mutex
+	defaultTTL time.Duration
+	stop       chan struct{}
+	stopOnce   sync.Once
+}
+
+type mapCacheEntry struct {
+	value    interface{}
+	expireAt time.Time
+}
+
+func (e *mapCacheEntry) expired(now time.Time) bool {
+	return !e.expireAt.IsZero() && !now.Before(e.expireAt)
 }
 
 func newMapCache() *MapCache {
 	return &MapCache{}
 }
 
+// NewMapCache creates a MapCache whose entries expire after defaultTTL
+// (zero means never expire). Expired entries are removed in background every
+// cleanupInterval if it's positive, call Close to stop the background cleanup.
+func NewMapCache(defaultTTL, cleanupInterval time.Duration) *MapCache {
+	m := &MapCache{defaultTTL: defaultTTL}
+	if cleanupInterval > 0 {
+		m.stop = make(chan struct{})
+		go m.cleanupLoop(cleanupInterval)
+	}
+	return m
+}
+
 var _ Cacher = (*MapCache)(nil)
+var _ TTLSetter = (*MapCache)(nil)
+var _ Deleter = (*MapCache)(nil)
+
+func (m *MapCache) Set(ctx context.Context, key, value interface{}) error {
+	return m.SetWithTTL(ctx, key, value, m.defaultTTL)
+}
+
+// SetWithTTL sets value with a ttl, the default TTL is used if ttl is not positive.
+func (m *MapCache) SetWithTTL(_ context.Context, key, value interface{}, ttl time.Duration) error {
+	if ttl <= 0 {
+		ttl = m.defaultTTL
+	}
 
-func (m *MapCache) Set(_ context.Context, key, value interface{}) error {
-	m.c.Store(key, value)
+	entry := &mapCacheEntry{value: value}
+	if ttl > 0 {
+		entry.expireAt = time.Now().Add(ttl)
+	}
+	m.mu.Lock()
+	m.c.Store(key, entry)
+	m.mu.Unlock()
 	return nil
 }
 
 func (m *MapCache) Get(_ context.Context, key interface{}) (interface{}, error) {
 	if v, ok := m.c.Load(key); ok {
-		return v, nil
+		entry := v.(*mapCacheEntry)
+		if !entry.expired(time.Now()) {
+			return entry.value, nil
+		}
+		m.deleteExpired(key, entry)
 	}
 	return nil, &ErrNil{}
 }
 
+// deleteExpired removes the key if it's still bound to the expired entry.
+func (m *MapCache) deleteExpired(key interface{}, entry *mapCacheEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if v, ok := m.c.Load(key); ok && v.(*mapCacheEntry) == entry {
+		m.c.Delete(key)
+		defaultCacheIndex.forget(m, key)
+	}
+}
+
+// Delete removes the keys.
+func (m *MapCache) Delete(_ context.Context, keys ...interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range keys {
+		m.c.Delete(key)
+	}
+	return nil
+}
+
+// Len returns the number of entries, including expired ones not yet removed.
+func (m *MapCache) Len() (n int) {
+	m.c.Range(func(_, _ interface{}) bool {
+		n++
+		return true
+	})
+	return
+}
+
+// DeleteExpired removes all expired entries.
+func (m *MapCache) DeleteExpired() {
+	now := time.Now()
+	m.c.Range(func(key, value interface{}) bool {
+		if entry := value.(*mapCacheEntry); entry.expired(now) {
+			m.deleteExpired(key, entry)
+		}
+		return true
+	})
+}
+
+// Close stops the background cleanup.
+func (m *MapCache) Close() {
+	if m.stop == nil {
+		return
+	}
+	m.stopOnce.Do(func() {
+		close(m.stop)
+	})
+}
+
+func (m *MapCache) cleanupLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.DeleteExpired()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
 const (
-	cacheKeyTem = "%s#%s#%s"
+	cacheKeyTem       = "%s#%s#%s"
+	sharedCacheKeyTem = "portal:%s.%s"
 )
 
 var (
 	DefaultCache    = newMapCache()
 	portalCache     Cacher
 	isCacheDisabled = false
+	// negativeCacheTTL is the TTL of nil results and errors in the shared cache, zero
+	// means they're shared only for fields with tag option `cachenil` or `cacheerr`.
+	negativeCacheTTL time.Duration
 )
 
-// SetCache enable cache strategy
+// SetCache enable cache strategy, c is the backing store of values with stable
+// cache keys, which are shared by all dumps. Use option `UseCache` to set the
+// cache of a Chell instead.
 func SetCache(c Cacher) {
 	if c == nil {
 		isCacheDisabled = true
@@ -61,15 +207,306 @@ func SetCache(c Cacher) {
 	portalCache = c
 }
 
+// SetNegativeCacheTTL enables caching nil results and errors of all cached fields
+// in the shared cache for ttl, like tagging them with `cachenil` and `cacheerr`. Zero disables it.
+func SetNegativeCacheTTL(ttl time.Duration) {
+	negativeCacheTTL = ttl
+}
+
+// isTransientError reports whether err is a context error or a panic.
+func isTransientError(err error) bool {
+	switch cause := errors.Cause(err); cause {
+	case nil:
+		return false
+	case context.Canceled, context.DeadlineExceeded:
+		return true
+	default:
+		_, ok := cause.(*PanicError)
+		return ok
+	}
+}
+
+// negativeResult is cached for a nil result or an error, so that it's
+// distinguishable from a miss.
+type negativeResult struct {
+	Err string
+}
+
+func init() {
+	RegisterCacheType(&negativeResult{})
+}
+
+// CachedError is returned instead of the original error of a method,
+// if the error is cached by tag option `cacheerr`.
+type CachedError struct {
+	Message string
+}
+
+func (e *CachedError) Error() string {
+	return e.Message
+}
+
+// unwrapNegative returns the nil result or the error of a negative result.
+func unwrapNegative(v interface{}) (interface{}, error) {
+	neg, ok := v.(*negativeResult)
+	if !ok {
+		return v, nil
+	}
+	if neg.Err != "" {
+		return nil, &CachedError{Message: neg.Err}
+	}
+	return nil, nil
+}
+
+// CacheIdentifier can be implemented by models to provide a stable
+// identity (e.g. primary key) used in cache keys. Without a stable identity,
+// portal falls back to the tag option `cacheid` of the field, and finally
+// the address of the model, which is meaningful only in the current process
+// while the model is alive.
+type CacheIdentifier interface {
+	PortalCacheID() string
+}
+
+// cacheOption holds the cache settings of a schema field.
+type cacheOption struct {
+	ttl time.Duration
+	// idAttrs are chaining attributes of the source object to get
+	// its identity, parsed from tag option `cacheid`.
+	idAttrs []string
+	// parentKey is the key of the previous method in an attribute chain,
+	// it identifies the object returned by that method.
+	parentKey *cacheKey
+	// varyNames are names of context values folded into the key,
+	// parsed from tag option `cachevary`.
+	varyNames []string
+	// tags are the invalidation tags, parsed from tag option `cachetags`.
+	tags []string
+	// cacheNil and cacheErr enable caching nil results in the shared cache and errors
+	// by tag option `cachenil` and `cacheerr`, with optional TTLs.
+	cacheNil bool
+	nilTTL   time.Duration
+	cacheErr bool
+	errTTL   time.Duration
+}
+
+// withParent returns a copy of the option for the next method in an attribute chain.
+func (opt *cacheOption) withParent(parent *cacheKey) *cacheOption {
+	if opt == nil {
+		return nil
+	}
+	next := *opt
+	next.idAttrs = nil
+	next.parentKey = parent
+	return &next
+}
+
+// negativeTTL returns the ttl of a nil result or an error, ok is false if
+// it should not be cached. The ttl of the option is used first, then the
+// global negative cache TTL, and finally the TTL of the field.
+func (opt *cacheOption) negativeTTL(isErr bool) (ttl time.Duration, ok bool) {
+	if opt == nil {
+		return 0, false
+	}
+
+	enabled, ttl := opt.cacheNil, opt.nilTTL
+	if isErr {
+		enabled, ttl = opt.cacheErr, opt.errTTL
+	}
+	if !enabled && negativeCacheTTL <= 0 {
+		return 0, false
+	}
+
+	if ttl <= 0 {
+		ttl = negativeCacheTTL
+	}
+	if ttl <= 0 {
+		ttl = opt.ttl
+	}
+	return ttl, true
+}
+
+func (opt *cacheOption) cacheTTL() time.Duration {
+	if opt == nil {
+		return 0
+	}
+	return opt.ttl
+}
+
+// cacheKey is the key of a cached method result with the field cache settings.
+type cacheKey struct {
+	key string
+	opt *cacheOption
+	// stable means the key is derived from stable identities instead of
+	// memory addresses, so it's valid across dumps and processes.
+	stable bool
+	// obj is the object whose address is used in an unstable key.
+	obj interface{}
+	// namespace is the package path of the receiver.
+	namespace string
+	// method is ReceiverName#MethodName.
+	method string
+	// identities are the stable identities of the objects the key derived from.
+	identities []string
+}
+
+// sharedKey is the key namespaced by the package of the receiver,
+// used in the configured Cacher.
+func (ck *cacheKey) sharedKey() string {
+	return fmt.Sprintf(sharedCacheKeyTem, ck.namespace, ck.key)
+}
+
 // genCacheKey generate cache key
-// rules: ReceiverName#MethodName#cacheID
-// eg. meth:GetName UserSchema#GetName#0xc000498150,
-// attr:Name UserModel#Name#0xc000498150
-func genCacheKey(ctx context.Context, receiver interface{}, cacheObj interface{}, methodName string) *string {
-	cacheID := defaultCacheID(cacheObj)
+// rules: ReceiverName#MethodName#cacheID[#vary]
+// eg. meth:GetName UserSchema#GetName#UserModel:42,
+// attr:Name UserModel#Name#UserModel:42,
+// attr:Profile.Name Profile#Name#UserModel#Profile#UserModel:42,
+// meth:IsFollowedByMe;cachevary:user_id UserSchema#IsFollowedByMe#UserModel:42#user_id=1:1,
+// without stable identity: UserModel#Name#0xc000498150
+func genCacheKey(ctx context.Context, receiver interface{}, cacheObj interface{}, methodName string, opt *cacheOption) *cacheKey {
+	cacheID, stable := stableCacheID(ctx, cacheObj, opt)
+	if !stable {
+		cacheID = defaultCacheID(cacheObj)
+	}
 
 	ck := fmt.Sprintf(cacheKeyTem, structName(receiver), methodName, cacheID)
-	return &ck
+	if opt == nil || opt.parentKey == nil || cacheID != opt.parentKey.key {
+		// the parent key is already varied.
+		if vary := cacheVary(ctx, opt); vary != "" {
+			ck += "#" + vary
+		}
+	}
+	key := &cacheKey{
+		key:       ck,
+		opt:       opt,
+		stable:    stable,
+		namespace: pkgPath(receiver),
+		method:    structName(receiver) + "#" + methodName,
+	}
+	switch {
+	case !stable:
+		key.obj = cacheObj
+	case opt != nil && opt.parentKey != nil && cacheID == opt.parentKey.key:
+		key.identities = opt.parentKey.identities
+	default:
+		key.identities = []string{cacheID}
+	}
+	return key
+}
+
+// CacheVaryKey is the context key of a value folded into cache keys by tag
+// option `cachevary`, e.g. a field tagged with `cachevary:user_id` reads
+// `ctx.Value(CacheVaryKey("user_id"))`. Use RegisterCacheVaryKey to map a
+// name to an existing context key instead.
+type CacheVaryKey string
+
+var cacheVaryKeyMap sync.Map
+
+// RegisterCacheVaryKey maps the name used in tag option `cachevary` to a context key.
+// Example:
+// ```
+// portal.RegisterCacheVaryKey("user_id", auth.UserIDContextKey)
+// // then tag the field with `portal:"meth:IsFollowedByMe;cachevary:user_id"`
+// ```
+func RegisterCacheVaryKey(name string, ctxKey interface{}) {
+	cacheVaryKeyMap.Store(name, ctxKey)
+}
+
+func cacheVaryValue(ctx context.Context, name string) interface{} {
+	if key, ok := cacheVaryKeyMap.Load(name); ok {
+		return ctx.Value(key)
+	}
+	return ctx.Value(CacheVaryKey(name))
+}
+
+// varyPart formats a vary value with its length, so separators in values
+// never make different values collide.
+func varyPart(name, value string) string {
+	return fmt.Sprintf("%s=%d:%s", name, len(value), value)
+}
+
+// cacheVary folds the context values into a string by the field's `cachevary`
+// names and the `CacheVaryFunc` of current dump.
+func cacheVary(ctx context.Context, opt *cacheOption) string {
+	var parts []string
+	if opt != nil {
+		for _, name := range opt.varyNames {
+			v := cacheVaryValue(ctx, name)
+			if isNil(v) {
+				parts = append(parts, name+"=")
+			} else {
+				parts = append(parts, varyPart(name, fmt.Sprint(reflect.Indirect(reflect.ValueOf(v)).Interface())))
+			}
+		}
+	}
+
+	if fn := cacheVaryFuncFromContext(ctx); fn != nil {
+		parts = append(parts, varyPart("vary", fn(ctx)))
+	}
+	return strings.Join(parts, ",")
+}
+
+// stableCacheID gets the stable identity of cacheObj by order:
+// 1. `PortalCacheID()` of the object
+// 2. the key of the method returning the object in an attribute chain
+// 3. the attribute specified by tag option `cacheid`
+func stableCacheID(ctx context.Context, cacheObj interface{}, opt *cacheOption) (string, bool) {
+	if id, ok := portalCacheID(cacheObj); ok {
+		return typeName(cacheObj) + ":" + id, true
+	}
+
+	if opt == nil {
+		return "", false
+	}
+
+	if opt.parentKey != nil {
+		return opt.parentKey.key, opt.parentKey.stable
+	}
+
+	if len(opt.idAttrs) > 0 {
+		id, err := nestedValue(ctx, cacheObj, opt.idAttrs, nil, nil)
+		if err != nil || isNil(id) {
+			logger.Warnf("[portal.cache] cannot get cache id '%s' of '%s': %v", strings.Join(opt.idAttrs, "."), typeName(cacheObj), err)
+			return "", false
+		}
+		return fmt.Sprintf("%s:%v", typeName(cacheObj), reflect.Indirect(reflect.ValueOf(id)).Interface()), true
+	}
+	return "", false
+}
+
+func portalCacheID(obj interface{}) (string, bool) {
+	if identifier, ok := obj.(CacheIdentifier); ok {
+		return identifier.PortalCacheID(), true
+	}
+
+	// value type whose pointer implements the interface.
+	rv := reflect.ValueOf(obj)
+	if rv.IsValid() && rv.Kind() != reflect.Ptr {
+		ptr := reflect.New(rv.Type())
+		ptr.Elem().Set(rv)
+		if identifier, ok := ptr.Interface().(CacheIdentifier); ok {
+			return identifier.PortalCacheID(), true
+		}
+	}
+	return "", false
+}
+
+func typeName(obj interface{}) string {
+	typ := reflect.TypeOf(obj)
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ.Name() != "" {
+		return typ.Name()
+	}
+	return typ.String()
+}
+
+func pkgPath(obj interface{}) string {
+	typ := reflect.TypeOf(obj)
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return typ.PkgPath()
 }
 
 // defaultCacheID is the addr of src struct
@@ -81,9 +518,15 @@ type cachable interface {
 	PortalDisableCache() bool
 }
 
+// cacheGroup caches values of a dump. Values are always kept in cache, which
+// lives as long as the dump or the request. Values with stable keys are also
+// stored in the configured Cacher, so they can be shared across dumps and processes.
 type cacheGroup struct {
 	cache Cacher
 	g     *singleflight.Group
+	// requestScoped means the group is attached to a context
+	// by WithRequestCache and shared by dumps with that context.
+	requestScoped bool
 }
 
 func newCacheGroup(cache Cacher) *cacheGroup {
@@ -93,6 +536,123 @@ func newCacheGroup(cache Cacher) *cacheGroup {
 	}
 }
 
-func (cg *cacheGroup) valid() bool {
-	return portalCache != nil && cg.cache != nil
+// sharedCache returns the Cacher set by option `UseCache`, or by `SetCache`.
+func sharedCache(ctx context.Context) Cacher {
+	if c := cacherFromContext(ctx); c != nil {
+		return c
+	}
+	if isCacheDisabled {
+		return nil
+	}
+	return portalCache
+}
+
+func (cg *cacheGroup) valid(ctx context.Context) bool {
+	if cg.cache == nil {
+		return false
+	}
+	return sharedCache(ctx) != nil || (cg.requestScoped && !isCacheDisabled)
+}
+
+// pinnedValue keeps the object of an unstable cache key alive with the cached
+// value, so that its address cannot be reused by another object while cached.
+type pinnedValue struct {
+	obj   interface{}
+	value interface{}
+}
+
+func (cg *cacheGroup) get(ctx context.Context, ck *cacheKey) (interface{}, error) {
+	v, err := cg.cache.Get(ctx, ck.key)
+	if err == nil {
+		if pinned, ok := v.(*pinnedValue); ok {
+			return pinned.value, nil
+		}
+		return v, nil
+	}
+
+	shared := sharedCache(ctx)
+	if !ck.stable || shared == nil {
+		return nil, err
+	}
+
+	v, err = getShared(ctx, shared, ck.sharedKey())
+	if err != nil {
+		return nil, err
+	}
+	if err := setWithTTL(ctx, cg.cache, ck.key, v, ck.opt.cacheTTL()); err != nil {
+		logger.Warnf("[portal.cache] failed to set cache '%s': %s", ck.key, err)
+	}
+	return v, nil
+}
+
+// getShared gets the value from values prefetched for many objects first.
+func getShared(ctx context.Context, shared Cacher, key string) (interface{}, error) {
+	if b := cacheBatchFromContext(ctx); b != nil {
+		if v, ok, known := b.get(key); known {
+			if !ok {
+				return nil, &ErrNil{}
+			}
+			return v, nil
+		}
+	}
+	return shared.Get(ctx, key)
+}
+
+func (cg *cacheGroup) set(ctx context.Context, ck *cacheKey, value interface{}) error {
+	return cg.setWithTTL(ctx, ck, value, ck.opt.cacheTTL())
+}
+
+// setNegative caches a nil result or an error. Nil results are always kept in
+// the cache of the dump or the request like other values, while they're stored
+// in the shared Cacher only if enabled for the key. Errors are cached only if enabled.
+// Results of canceled dumps, context errors and panics are transient, they're never cached.
+func (cg *cacheGroup) setNegative(ctx context.Context, ck *cacheKey, err error) error {
+	if ctx.Err() != nil || isTransientError(err) {
+		return nil
+	}
+
+	neg := &negativeResult{}
+	if err != nil {
+		neg.Err = err.Error()
+	}
+
+	ttl, ok := ck.opt.negativeTTL(err != nil)
+	if !ok {
+		if err != nil {
+			return nil
+		}
+		return cg.setLocal(ctx, ck, neg, ck.opt.cacheTTL())
+	}
+	return cg.setWithTTL(ctx, ck, neg, ttl)
+}
+
+func (cg *cacheGroup) setWithTTL(ctx context.Context, ck *cacheKey, value interface{}, ttl time.Duration) error {
+	if ck.stable {
+		if shared := sharedCache(ctx); shared != nil {
+			if b := cacheBatchFromContext(ctx); b != nil {
+				b.set(ck.sharedKey(), value, ttl)
+			} else if err := setWithTTL(ctx, shared, ck.sharedKey(), value, ttl); err != nil {
+				return err
+			}
+			defaultCacheIndex.add(shared, ck)
+		}
+	}
+	return cg.setLocal(ctx, ck, value, ttl)
+}
+
+// setLocal sets the value in the cache of the dump or the request only.
+func (cg *cacheGroup) setLocal(ctx context.Context, ck *cacheKey, value interface{}, ttl time.Duration) error {
+	if ck.obj != nil {
+		value = &pinnedValue{obj: ck.obj, value: value}
+	}
+	return setWithTTL(ctx, cg.cache, ck.key, value, ttl)
+}
+
+func setWithTTL(ctx context.Context, c Cacher, key, value interface{}, ttl time.Duration) error {
+	if ttl > 0 {
+		if ts, ok := c.(TTLSetter); ok {
+			return ts.SetWithTTL(ctx, key, value, ttl)
+		}
+	}
+	return c.Set(ctx, key, value)
 }
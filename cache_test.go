@@ -1,11 +1,15 @@
 package portal
 
 import (
+	"context"
 	"fmt"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -190,3 +194,540 @@ func TestDumpWithCacheDisabled(t *testing.T) {
 	assert.Equal(t, int32(2), atomic.LoadInt32(&metaCounter))
 	atomic.StoreInt32(&metaCounter, 0)
 }
+
+func TestMapCache_TTL(t *testing.T) {
+	ctx := context.TODO()
+	c := NewMapCache(50*time.Millisecond, 0)
+
+	assert.Nil(t, c.Set(ctx, "a", 1))
+	assert.Nil(t, c.SetWithTTL(ctx, "b", 2, time.Hour))
+	v, err := c.Get(ctx, "a")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, v)
+
+	time.Sleep(60 * time.Millisecond)
+	_, err = c.Get(ctx, "a")
+	assert.IsType(t, &ErrNil{}, err)
+	v, err = c.Get(ctx, "b")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, v)
+
+	// never expire by default
+	c = NewMapCache(0, 0)
+	assert.Nil(t, c.Set(ctx, "a", 1))
+	time.Sleep(10 * time.Millisecond)
+	v, err = c.Get(ctx, "a")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, v)
+}
+
+func TestMapCache_DeleteExpired(t *testing.T) {
+	ctx := context.TODO()
+	c := NewMapCache(0, 0)
+	assert.Nil(t, c.SetWithTTL(ctx, "a", 1, 10*time.Millisecond))
+	assert.Nil(t, c.Set(ctx, "b", 2))
+	time.Sleep(20 * time.Millisecond)
+	c.DeleteExpired()
+	assert.Equal(t, 1, c.Len())
+
+	c = NewMapCache(10*time.Millisecond, 5*time.Millisecond)
+	defer c.Close()
+	assert.Nil(t, c.Set(ctx, "a", 1))
+	assert.Eventually(t, func() bool {
+		return c.Len() == 0
+	}, time.Second, 5*time.Millisecond)
+	c.Close()
+}
+
+func TestMapCache_DeleteExpiredKeepsFreshEntry(t *testing.T) {
+	ctx := context.TODO()
+	c := NewMapCache(0, 0)
+	assert.Nil(t, c.SetWithTTL(ctx, "a", 1, time.Millisecond))
+	v, _ := c.c.Load("a")
+	stale := v.(*mapCacheEntry)
+	time.Sleep(5 * time.Millisecond)
+
+	// the key is set again after the stale entry was loaded by Get.
+	assert.Nil(t, c.Set(ctx, "a", 2))
+	c.deleteExpired("a", stale)
+	value, err := c.Get(ctx, "a")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, value)
+}
+
+type ttlRecordCache struct {
+	MapCache
+	mu   sync.Mutex
+	ttls map[interface{}]time.Duration
+}
+
+func (c *ttlRecordCache) SetWithTTL(ctx context.Context, key, value interface{}, ttl time.Duration) error {
+	c.mu.Lock()
+	c.ttls[key] = ttl
+	c.mu.Unlock()
+	return c.MapCache.SetWithTTL(ctx, key, value, ttl)
+}
+
+type TTLStudentSchema struct {
+	FullName  string `portal:"attr:FullName;cachettl:30s"`
+	ShortName string `portal:"meth:GetShortName;cachettl:1m"`
+	ID        int    `portal:"attr:ID"`
+}
+
+func (sch *TTLStudentSchema) GetShortName(s *Student) string {
+	return string([]rune(s.FirstName)[0]) + string([]rune(s.LastName)[0])
+}
+
+func TestSchemaFieldCacheTTL(t *testing.T) {
+	SetCache(DefaultCache)
+	defer SetCache(nil)
+
+	c := &ttlRecordCache{ttls: make(map[interface{}]time.Duration)}
+	s := Student{ID: 1, FirstName: "Harry", LastName: "Potter"}
+	sch := newSchema(&TTLStudentSchema{})
+	sch.cacheGroup = newCacheGroup(c)
+	for _, f := range sch.fields {
+		_, err := sch.fieldValueFromSrc(context.TODO(), f, &s, false)
+		assert.Nil(t, err)
+	}
+
+	ttls := make(map[string]time.Duration)
+	for k, v := range c.ttls {
+		ttls[strings.Split(k.(string), "#")[1]] = v
+	}
+	assert.Equal(t, map[string]time.Duration{"FullName": 30 * time.Second, "GetShortName": time.Minute}, ttls)
+}
+
+type IdentifiedModel struct {
+	ID int
+}
+
+func (m *IdentifiedModel) PortalCacheID() string {
+	return fmt.Sprintf("%d", m.ID)
+}
+
+func (m *IdentifiedModel) Profile() *Student {
+	return &Student{ID: m.ID, FirstName: "Harry", LastName: "Potter"}
+}
+
+type IdentifiedSchema struct {
+	Name     string `portal:"meth:GetName"`
+	FullName string `portal:"attr:Profile.FullName"`
+}
+
+func (s *IdentifiedSchema) GetName(m *IdentifiedModel) string {
+	return "name"
+}
+
+func TestGenCacheKey_Stable(t *testing.T) {
+	ctx := context.TODO()
+
+	m := &IdentifiedModel{ID: 42}
+	ck := genCacheKey(ctx, &IdentifiedSchema{}, m, "GetName", &cacheOption{})
+	assert.Equal(t, "IdentifiedSchema#GetName#IdentifiedModel:42", ck.key)
+	assert.True(t, ck.stable)
+
+	// value whose pointer implements CacheIdentifier
+	ck = genCacheKey(ctx, &IdentifiedSchema{}, IdentifiedModel{ID: 42}, "GetName", nil)
+	assert.Equal(t, "IdentifiedSchema#GetName#IdentifiedModel:42", ck.key)
+
+	// attribute chain derives identity from the parent key
+	child := genCacheKey(ctx, &Student{}, &Student{}, "FullName", (&cacheOption{}).withParent(ck))
+	assert.Equal(t, "Student#FullName#IdentifiedSchema#GetName#IdentifiedModel:42", child.key)
+	assert.True(t, child.stable)
+
+	// fallback to tag option `cacheid`
+	s := &Student{ID: 7}
+	ck = genCacheKey(ctx, s, s, "FullName", &cacheOption{idAttrs: []string{"ID"}})
+	assert.Equal(t, "Student#FullName#Student:7", ck.key)
+	assert.True(t, ck.stable)
+
+	// fallback to address
+	ck = genCacheKey(ctx, s, s, "FullName", &cacheOption{})
+	assert.Equal(t, fmt.Sprintf("Student#FullName#%p", s), ck.key)
+	assert.False(t, ck.stable)
+
+	ck = genCacheKey(ctx, s, s, "FullName", &cacheOption{idAttrs: []string{"NotFound"}})
+	assert.False(t, ck.stable)
+
+	unstable := genCacheKey(ctx, s, s, "FullName", nil)
+	child = genCacheKey(ctx, s, s, "FullName", (&cacheOption{}).withParent(unstable))
+	assert.False(t, child.stable)
+}
+
+type CacheIDStudentSchema struct {
+	FullName  string `portal:"attr:FullName;cacheid:ID"`
+	ShortName string `portal:"meth:GetShortName;cacheid:ID"`
+}
+
+func (sch *CacheIDStudentSchema) GetShortName(s *Student) string {
+	return string([]rune(s.FirstName)[0]) + string([]rune(s.LastName)[0])
+}
+
+func TestSchemaFieldStableCacheKeys(t *testing.T) {
+	SetCache(DefaultCache)
+	defer SetCache(nil)
+
+	c := newMapCache()
+	sch := newSchema(&IdentifiedSchema{})
+	sch.cacheGroup = newCacheGroup(c)
+	for _, f := range sch.fields {
+		_, err := sch.fieldValueFromSrc(context.TODO(), f, &IdentifiedModel{ID: 1}, false)
+		assert.Nil(t, err)
+	}
+
+	sch2 := newSchema(&CacheIDStudentSchema{})
+	sch2.cacheGroup = newCacheGroup(c)
+	for _, f := range sch2.fields {
+		_, err := sch2.fieldValueFromSrc(context.TODO(), f, &Student{ID: 2, FirstName: "Harry", LastName: "Potter"}, false)
+		assert.Nil(t, err)
+	}
+
+	var keys []string
+	c.c.Range(func(key, _ interface{}) bool {
+		keys = append(keys, key.(string))
+		return true
+	})
+	assert.ElementsMatch(t, []string{
+		"IdentifiedSchema#GetName#IdentifiedModel:1",
+		"IdentifiedModel#Profile#IdentifiedModel:1",
+		"Student#FullName#IdentifiedModel#Profile#IdentifiedModel:1",
+		"CacheIDStudentSchema#GetShortName#Student:2",
+		"Student#FullName#Student:2",
+	}, keys)
+}
+
+type viewerCtxKey struct{}
+
+type FollowSchema struct {
+	IsFollowedByMe bool   `portal:"meth:GetIsFollowedByMe;cachevary:viewer"`
+	Greeting       string `portal:"meth:GetGreeting"`
+}
+
+func (s *FollowSchema) GetIsFollowedByMe(ctx context.Context, m *IdentifiedModel) bool {
+	viewer, _ := ctx.Value(viewerCtxKey{}).(int)
+	return viewer%2 == 0
+}
+
+func (s *FollowSchema) GetGreeting(ctx context.Context, m *IdentifiedModel) string {
+	viewer, _ := ctx.Value(viewerCtxKey{}).(int)
+	return fmt.Sprintf("hello, %d", viewer)
+}
+
+func TestCacheVary(t *testing.T) {
+	SetCache(DefaultCache)
+	defer SetCache(nil)
+	RegisterCacheVaryKey("viewer", viewerCtxKey{})
+	defer cacheVaryKeyMap.Delete("viewer")
+
+	// a process-wide cache shared by all dumps
+	cg := newCacheGroup(newMapCache())
+	dump := func(ctx context.Context, viewer int) *FollowSchema {
+		ctx = context.WithValue(ctx, viewerCtxKey{}, viewer)
+		var dst FollowSchema
+		sch := newSchema(&dst)
+		sch.cacheGroup = cg
+		for _, f := range sch.fields {
+			val, err := sch.fieldValueFromSrc(ctx, f, &IdentifiedModel{ID: 1}, false)
+			assert.Nil(t, err)
+			assert.Nil(t, f.setValue(val))
+		}
+		return &dst
+	}
+
+	ctx := context.TODO()
+	assert.True(t, dump(ctx, 2).IsFollowedByMe)
+	assert.False(t, dump(ctx, 1).IsFollowedByMe)
+	assert.True(t, dump(ctx, 4).IsFollowedByMe)
+	assert.False(t, dump(ctx, 3).IsFollowedByMe)
+
+	// without cachevary the value is shared
+	assert.Equal(t, "hello, 2", dump(ctx, 2).Greeting)
+	assert.Equal(t, "hello, 2", dump(ctx, 1).Greeting)
+
+	// CacheVaryFunc folds into all keys of the dump
+	ctx = withCacheVaryFunc(ctx, func(ctx context.Context) string {
+		return fmt.Sprint(ctx.Value(viewerCtxKey{}))
+	})
+	assert.Equal(t, "hello, 5", dump(ctx, 5).Greeting)
+	assert.Equal(t, "hello, 6", dump(ctx, 6).Greeting)
+	assert.Equal(t, "hello, 5", dump(ctx, 5).Greeting)
+}
+
+func TestCacheVary_DumpWithUseCache(t *testing.T) {
+	RegisterCacheVaryKey("viewer", viewerCtxKey{})
+	defer cacheVaryKeyMap.Delete("viewer")
+
+	cache := newMapCache()
+	dump := func(viewer int) *FollowSchema {
+		ctx := context.WithValue(context.TODO(), viewerCtxKey{}, viewer)
+		var dst FollowSchema
+		assert.Nil(t, DumpWithContext(ctx, &dst, &IdentifiedModel{ID: 1}, UseCache(cache)))
+		return &dst
+	}
+
+	assert.True(t, dump(2).IsFollowedByMe)
+	assert.False(t, dump(1).IsFollowedByMe)
+	assert.True(t, dump(2).IsFollowedByMe)
+	assert.Equal(t, "hello, 2", dump(1).Greeting)
+}
+
+func TestCacheVary_Escaped(t *testing.T) {
+	opt := &cacheOption{varyNames: []string{"a", "b"}}
+	m := &IdentifiedModel{ID: 1}
+
+	ctx := context.WithValue(context.TODO(), CacheVaryKey("a"), "1,b=2")
+	k1 := genCacheKey(ctx, &FollowSchema{}, m, "GetIsFollowedByMe", opt)
+
+	ctx = context.WithValue(context.TODO(), CacheVaryKey("a"), "1")
+	ctx = context.WithValue(ctx, CacheVaryKey("b"), "2")
+	k2 := genCacheKey(ctx, &FollowSchema{}, m, "GetIsFollowedByMe", opt)
+	assert.NotEqual(t, k1.key, k2.key)
+}
+
+func TestCacheVaryKey(t *testing.T) {
+	opt := &cacheOption{varyNames: []string{"user_id", "locale"}}
+	m := &IdentifiedModel{ID: 1}
+
+	ctx := context.WithValue(context.TODO(), CacheVaryKey("user_id"), 42)
+	ck := genCacheKey(ctx, &FollowSchema{}, m, "GetIsFollowedByMe", opt)
+	assert.Equal(t, "FollowSchema#GetIsFollowedByMe#IdentifiedModel:1#user_id=2:42,locale=", ck.key)
+
+	child := genCacheKey(ctx, m, m, "Profile", opt.withParent(ck))
+	assert.Equal(t, "IdentifiedModel#Profile#IdentifiedModel:1#user_id=2:42,locale=", child.key)
+
+	s := &Student{}
+	child = genCacheKey(ctx, s, s, "FullName", opt.withParent(ck))
+	assert.Equal(t, "Student#FullName#"+ck.key, child.key)
+
+	ctx = withCacheVaryFunc(ctx, func(ctx context.Context) string { return "zh" })
+	ck = genCacheKey(ctx, &FollowSchema{}, m, "GetGreeting", &cacheOption{})
+	assert.Equal(t, "FollowSchema#GetGreeting#IdentifiedModel:1#vary=2:zh", ck.key)
+}
+
+type countedModel struct {
+	ID    int
+	calls *int32
+}
+
+func (m *countedModel) PortalCacheID() string {
+	return fmt.Sprintf("%d", m.ID)
+}
+
+type CountedSchema struct {
+	Name  string `portal:"meth:GetName"`
+	Title string `portal:"meth:GetTitle;cachettl:1m"`
+}
+
+func (s *CountedSchema) GetName(m *countedModel) string {
+	atomic.AddInt32(m.calls, 1)
+	return fmt.Sprintf("name_%d", m.ID)
+}
+
+func (s *CountedSchema) GetTitle(m *countedModel) string {
+	atomic.AddInt32(m.calls, 1)
+	return fmt.Sprintf("title_%d", m.ID)
+}
+
+type UnstableSchema struct {
+	Name string `portal:"meth:GetName"`
+}
+
+func (s *UnstableSchema) GetName(m *Student) string {
+	return m.FirstName
+}
+
+func TestSetCache_SharedAcrossDumps(t *testing.T) {
+	c := &ttlRecordCache{ttls: make(map[interface{}]time.Duration)}
+	SetCache(c)
+	defer SetCache(nil)
+
+	var calls int32
+	for i := 0; i < 3; i++ {
+		var dst CountedSchema
+		assert.Nil(t, Dump(&dst, &countedModel{ID: 1, calls: &calls}))
+		assert.Equal(t, CountedSchema{Name: "name_1", Title: "title_1"}, dst)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	assert.Equal(t, map[interface{}]time.Duration{
+		"portal:github.com/ifaceless/portal.CountedSchema#GetTitle#countedModel:1": time.Minute,
+	}, c.ttls)
+
+	// keys of addresses are never stored in the configured cache
+	var dst UnstableSchema
+	assert.Nil(t, Dump(&dst, &Student{FirstName: "Harry"}))
+	assert.Equal(t, "Harry", dst.Name)
+	assert.Equal(t, 2, c.MapCache.Len())
+}
+
+func TestUseCache(t *testing.T) {
+	SetCache(nil)
+
+	var calls int32
+	c := newMapCache()
+	for i := 0; i < 3; i++ {
+		var dst CountedSchema
+		assert.Nil(t, Dump(&dst, &countedModel{ID: 1, calls: &calls}, UseCache(c)))
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	_, err := c.Get(context.TODO(), "portal:github.com/ifaceless/portal.CountedSchema#GetName#countedModel:1")
+	assert.Nil(t, err)
+
+	// the global cache is still disabled
+	var dst CountedSchema
+	assert.Nil(t, Dump(&dst, &countedModel{ID: 1, calls: &calls}))
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+}
+
+type NegativeSchema struct {
+	Owner   *string `portal:"meth:GetOwner;cachenil:1m"`
+	Manager *string `portal:"meth:GetManager"`
+}
+
+func (s *NegativeSchema) GetOwner(m *countedModel) *string {
+	atomic.AddInt32(m.calls, 1)
+	return nil
+}
+
+func (s *NegativeSchema) GetManager(m *countedModel) *string {
+	atomic.AddInt32(m.calls, 100)
+	return nil
+}
+
+type FailingSchema struct {
+	Name string `portal:"meth:GetName;cacheerr:5s"`
+}
+
+func (s *FailingSchema) GetName(m *countedModel) (string, error) {
+	atomic.AddInt32(m.calls, 1)
+	return "", fmt.Errorf("model %d not found", m.ID)
+}
+
+func TestNegativeCache(t *testing.T) {
+	c := &ttlRecordCache{ttls: make(map[interface{}]time.Duration)}
+
+	var calls int32
+	for i := 0; i < 3; i++ {
+		var dst NegativeSchema
+		assert.Nil(t, Dump(&dst, &countedModel{ID: 1, calls: &calls}, UseCache(c)))
+		assert.Nil(t, dst.Owner)
+	}
+	assert.Equal(t, int32(301), atomic.LoadInt32(&calls))
+	assert.Equal(t, map[interface{}]time.Duration{
+		"portal:github.com/ifaceless/portal.NegativeSchema#GetOwner#countedModel:1": time.Minute,
+	}, c.ttls)
+
+	// a cached nil is not a miss
+	v, err := c.Get(context.TODO(), "portal:github.com/ifaceless/portal.NegativeSchema#GetOwner#countedModel:1")
+	assert.Nil(t, err)
+	assert.Equal(t, &negativeResult{}, v)
+
+	calls = 0
+	for i := 0; i < 3; i++ {
+		var dst FailingSchema
+		err := Dump(&dst, &countedModel{ID: 1, calls: &calls}, UseCache(c))
+		assert.Contains(t, err.Error(), "model 1 not found")
+		if i > 0 {
+			assert.IsType(t, &CachedError{}, errors.Cause(err))
+		}
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	assert.Equal(t, 5*time.Second, c.ttls["portal:github.com/ifaceless/portal.FailingSchema#GetName#countedModel:1"])
+}
+
+func TestNegativeCache_NilNotSharedByDefault(t *testing.T) {
+	c := newMapCache()
+	var calls int32
+	for i := 0; i < 3; i++ {
+		var dst NegativeSchema
+		assert.Nil(t, Dump(&dst, &countedModel{ID: 3, calls: &calls}, UseCache(c)))
+	}
+	// GetManager isn't tagged with `cachenil`, it's called on every dump.
+	assert.Equal(t, int32(301), atomic.LoadInt32(&calls))
+	_, err := c.Get(context.TODO(), "portal:github.com/ifaceless/portal.NegativeSchema#GetManager#countedModel:3")
+	assert.IsType(t, &ErrNil{}, err)
+}
+
+func TestNegativeCache_NilCachedInRequest(t *testing.T) {
+	defer resetCacheSettings()()
+
+	ctx, release := WithRequestCache(context.TODO())
+	defer release()
+
+	var calls int32
+	model := &countedModel{ID: 4, calls: &calls}
+	for i := 0; i < 3; i++ {
+		var dst NegativeSchema
+		assert.Nil(t, DumpWithContext(ctx, &dst, model))
+		assert.Nil(t, dst.Manager)
+	}
+	// nil results are kept in the request cache like any other value.
+	assert.Equal(t, int32(101), atomic.LoadInt32(&calls))
+}
+
+type TimeoutSchema struct {
+	Name string `portal:"meth:GetName;cacheerr:5s"`
+}
+
+func (s *TimeoutSchema) GetName(m *countedModel) (string, error) {
+	atomic.AddInt32(m.calls, 1)
+	return "", context.DeadlineExceeded
+}
+
+func TestNegativeCache_SkipContextErrors(t *testing.T) {
+	c := newMapCache()
+	var calls int32
+	for i := 0; i < 3; i++ {
+		var dst TimeoutSchema
+		err := Dump(&dst, &countedModel{ID: 1, calls: &calls}, UseCache(c))
+		assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestSetNegativeCacheTTL(t *testing.T) {
+	SetNegativeCacheTTL(time.Second)
+	defer SetNegativeCacheTTL(0)
+
+	c := NewTieredCache(newMapCache(), NewByteStore(), GobCodec)
+	var calls int32
+	for i := 0; i < 3; i++ {
+		var dst NegativeSchema
+		assert.Nil(t, Dump(&dst, &countedModel{ID: 2, calls: &calls}, UseCache(c)))
+		assert.Nil(t, dst.Manager)
+	}
+	assert.Equal(t, int32(101), atomic.LoadInt32(&calls))
+
+	// the remote tier keeps negative results
+	c = NewTieredCache(newMapCache(), c.remote, GobCodec)
+	var dst NegativeSchema
+	assert.Nil(t, Dump(&dst, &countedModel{ID: 2, calls: &calls}, UseCache(c)))
+	assert.Equal(t, int32(101), atomic.LoadInt32(&calls))
+}
+
+func TestCacheOption_NegativeTTL(t *testing.T) {
+	opt := &cacheOption{ttl: time.Minute}
+	_, ok := opt.negativeTTL(false)
+	assert.False(t, ok)
+
+	opt = &cacheOption{ttl: time.Minute, cacheNil: true, cacheErr: true, errTTL: time.Second}
+	ttl, ok := opt.negativeTTL(false)
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, ttl)
+	ttl, ok = opt.negativeTTL(true)
+	assert.True(t, ok)
+	assert.Equal(t, time.Second, ttl)
+
+	SetNegativeCacheTTL(10 * time.Second)
+	defer SetNegativeCacheTTL(0)
+	ttl, ok = (&cacheOption{}).negativeTTL(true)
+	assert.True(t, ok)
+	assert.Equal(t, 10*time.Second, ttl)
+	ttl, _ = opt.negativeTTL(false)
+	assert.Equal(t, 10*time.Second, ttl)
+
+	child := opt.withParent(&cacheKey{key: "k"})
+	assert.True(t, child.cacheErr)
+	assert.Equal(t, time.Second, child.errTTL)
+}
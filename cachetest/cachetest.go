@@ -0,0 +1,169 @@
+// Package cachetest provides a contract test suite for implementations
+// of portal.Cacher.
+// Example:
+// ```
+// cachetest.Run(t, func() portal.Cacher { return NewRedisCache(client) })
+// ```
+package cachetest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ifaceless/portal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Run runs the contract tests against caches created by newCache,
+// a new cache is created for each test.
+// Tests of optional interfaces are skipped if not implemented.
+func Run(t *testing.T, newCache func() portal.Cacher) {
+	t.Run("GetMissing", func(t *testing.T) { testGetMissing(t, newCache()) })
+	t.Run("SetGet", func(t *testing.T) { testSetGet(t, newCache()) })
+	t.Run("Overwrite", func(t *testing.T) { testOverwrite(t, newCache()) })
+	t.Run("Concurrent", func(t *testing.T) { testConcurrent(t, newCache()) })
+	t.Run("TTL", func(t *testing.T) { testTTL(t, newCache()) })
+	t.Run("Delete", func(t *testing.T) { testDelete(t, newCache()) })
+	t.Run("Batch", func(t *testing.T) { testBatch(t, newCache()) })
+}
+
+func key(name string) string {
+	return "portal:github.com/ifaceless/portal/cachetest.Schema#" + name + "#Model:1"
+}
+
+func assertErrNil(t *testing.T, err error) {
+	t.Helper()
+	require.Error(t, err)
+	_, ok := err.(*portal.ErrNil)
+	assert.True(t, ok, "expected *portal.ErrNil, got %T: %s", err, err)
+}
+
+func testGetMissing(t *testing.T, c portal.Cacher) {
+	_, err := c.Get(context.TODO(), key("Missing"))
+	assertErrNil(t, err)
+}
+
+func testSetGet(t *testing.T, c portal.Cacher) {
+	ctx := context.TODO()
+	values := map[string]interface{}{
+		"String": "hello",
+		"Int":    42,
+		"Bool":   true,
+		"Float":  3.14,
+	}
+	for name, value := range values {
+		require.Nil(t, c.Set(ctx, key(name), value))
+	}
+	for name, value := range values {
+		v, err := c.Get(ctx, key(name))
+		require.Nil(t, err, name)
+		assert.Equal(t, value, v, name)
+	}
+}
+
+func testOverwrite(t *testing.T, c portal.Cacher) {
+	ctx := context.TODO()
+	require.Nil(t, c.Set(ctx, key("Name"), "a"))
+	require.Nil(t, c.Set(ctx, key("Name"), "b"))
+	v, err := c.Get(ctx, key("Name"))
+	require.Nil(t, err)
+	assert.Equal(t, "b", v)
+}
+
+func testConcurrent(t *testing.T, c portal.Cacher) {
+	ctx := context.TODO()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				k := key(fmt.Sprintf("Name%d", j%10))
+				assert.Nil(t, c.Set(ctx, k, fmt.Sprintf("value%d", j%10)))
+				if v, err := c.Get(ctx, k); err == nil {
+					assert.Equal(t, fmt.Sprintf("value%d", j%10), v)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func testTTL(t *testing.T, c portal.Cacher) {
+	ts, ok := c.(portal.TTLSetter)
+	if !ok {
+		t.Skip("portal.TTLSetter is not implemented")
+	}
+
+	ctx := context.TODO()
+	require.Nil(t, ts.SetWithTTL(ctx, key("Short"), "short", 50*time.Millisecond))
+	require.Nil(t, ts.SetWithTTL(ctx, key("Long"), "long", time.Hour))
+	v, err := c.Get(ctx, key("Short"))
+	require.Nil(t, err)
+	assert.Equal(t, "short", v)
+
+	assert.Eventually(t, func() bool {
+		_, err := c.Get(ctx, key("Short"))
+		return err != nil
+	}, 2*time.Second, 10*time.Millisecond)
+	_, err = c.Get(ctx, key("Short"))
+	assertErrNil(t, err)
+
+	v, err = c.Get(ctx, key("Long"))
+	require.Nil(t, err)
+	assert.Equal(t, "long", v)
+}
+
+func testDelete(t *testing.T, c portal.Cacher) {
+	d, ok := c.(portal.Deleter)
+	if !ok {
+		t.Skip("portal.Deleter is not implemented")
+	}
+
+	ctx := context.TODO()
+	for _, name := range []string{"A", "B", "C"} {
+		require.Nil(t, c.Set(ctx, key(name), name))
+	}
+	require.Nil(t, d.Delete(ctx, key("A"), key("B"), key("Missing")))
+	require.Nil(t, d.Delete(ctx))
+
+	for _, name := range []string{"A", "B"} {
+		_, err := c.Get(ctx, key(name))
+		assertErrNil(t, err)
+	}
+	v, err := c.Get(ctx, key("C"))
+	require.Nil(t, err)
+	assert.Equal(t, "C", v)
+}
+
+func testBatch(t *testing.T, c portal.Cacher) {
+	bc, ok := c.(portal.BatchCacher)
+	if !ok {
+		t.Skip("portal.BatchCacher is not implemented")
+	}
+
+	ctx := context.TODO()
+	require.Nil(t, bc.SetMulti(ctx, map[interface{}]interface{}{key("A"): "a", key("B"): 2}, 0))
+	require.Nil(t, bc.SetMulti(ctx, map[interface{}]interface{}{}, 0))
+	require.Nil(t, c.Set(ctx, key("C"), "c"))
+
+	values, err := bc.GetMulti(ctx, []interface{}{key("A"), key("B"), key("C"), key("Missing")})
+	require.Nil(t, err)
+	assert.Equal(t, map[interface{}]interface{}{key("A"): "a", key("B"): 2, key("C"): "c"}, values)
+
+	v, err := c.Get(ctx, key("B"))
+	require.Nil(t, err)
+	assert.Equal(t, 2, v)
+
+	if _, ok := c.(portal.TTLSetter); ok {
+		require.Nil(t, bc.SetMulti(ctx, map[interface{}]interface{}{key("Short"): "short"}, 50*time.Millisecond))
+		assert.Eventually(t, func() bool {
+			values, err := bc.GetMulti(ctx, []interface{}{key("Short")})
+			return err == nil && len(values) == 0
+		}, 2*time.Second, 10*time.Millisecond)
+	}
+}
@@ -0,0 +1,38 @@
+package cachetest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ifaceless/portal"
+)
+
+func TestMapCache(t *testing.T) {
+	Run(t, func() portal.Cacher {
+		return portal.NewMapCache(0, 0)
+	})
+}
+
+func TestMapCache_DefaultTTL(t *testing.T) {
+	Run(t, func() portal.Cacher {
+		return portal.NewMapCache(time.Hour, 0)
+	})
+}
+
+func TestLRUCache(t *testing.T) {
+	Run(t, func() portal.Cacher {
+		return portal.NewLRUCache(1000, 0)
+	})
+}
+
+func TestTieredCache(t *testing.T) {
+	codecs := map[string]portal.Codec{"json": portal.JSONCodec, "gob": portal.GobCodec}
+	for name, codec := range codecs {
+		codec := codec
+		t.Run(name, func(t *testing.T) {
+			Run(t, func() portal.Cacher {
+				return portal.NewTieredCache(portal.NewMapCache(0, 0), portal.NewByteStore(), codec)
+			})
+		})
+	}
+}
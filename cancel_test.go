@@ -0,0 +1,103 @@
+package portal
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type cancelModel struct {
+	ID        int
+	calls     *int32
+	cancelled *int32
+	cancel    context.CancelFunc
+}
+
+type SiblingSchema struct {
+	Fail string `portal:"meth:GetFail;async"`
+	Wait string `portal:"meth:GetWait;async"`
+}
+
+func (s *SiblingSchema) GetFail(ctx context.Context, m *cancelModel) (string, error) {
+	// let the sibling start
+	time.Sleep(20 * time.Millisecond)
+	return "", errors.New("failed to query")
+}
+
+func (s *SiblingSchema) GetWait(ctx context.Context, m *cancelModel) (string, error) {
+	select {
+	case <-ctx.Done():
+		atomic.AddInt32(m.cancelled, 1)
+		return "", ctx.Err()
+	case <-time.After(5 * time.Second):
+		return "timeout", nil
+	}
+}
+
+func TestDump_SiblingAbort(t *testing.T) {
+	var cancelled int32
+	var dst SiblingSchema
+	start := time.Now()
+	err := Dump(&dst, &cancelModel{cancelled: &cancelled})
+	assert.Contains(t, err.Error(), "failed to query")
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&cancelled))
+}
+
+type CancelSchema struct {
+	ID   int    `portal:"attr:ID"`
+	Name string `portal:"meth:GetName"`
+}
+
+func (s *CancelSchema) GetName(ctx context.Context, m *cancelModel) string {
+	atomic.AddInt32(m.calls, 1)
+	if m.ID == 3 {
+		m.cancel()
+	}
+	return "name"
+}
+
+func TestDump_CallerCancelled(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+		var calls int32
+		models := make([]*cancelModel, 10)
+		for i := range models {
+			models[i] = &cancelModel{ID: i, calls: &calls, cancel: cancel}
+		}
+
+		opts := []option{MaxConcurrency(1)}
+		if async {
+			opts = append(opts, CustomFieldTagMap(map[string]string{"CancelSchema.Name": "meth:GetName;async"}))
+		}
+		chell, err := New(opts...)
+		assert.Nil(t, err)
+
+		var dst []*CancelSchema
+		err = chell.DumpWithContext(ctx, &dst, models)
+		assert.Equal(t, context.Canceled, errors.Cause(err), "%v", err)
+		assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+		cancel()
+	}
+}
+
+func TestDump_AlreadyCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var calls int32
+	var dst CancelSchema
+	err := DumpWithContext(ctx, &dst, &cancelModel{calls: &calls})
+	assert.Equal(t, context.Canceled, errors.Cause(err))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls))
+
+	var cancelled int32
+	var sibling SiblingSchema
+	err = DumpWithContext(ctx, &sibling, &cancelModel{cancelled: &cancelled})
+	assert.Equal(t, context.Canceled, errors.Cause(err))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&cancelled))
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -15,7 +17,20 @@ type Chell struct {
 	disableConcurrency   bool
 	disableCache         bool
 	onlyFieldFilters     map[int][]*filterNode
-	excludeFieldFilters  map[int][]*filterNode
+	// onlyNone selects no fields of the schema, set by an empty `OnlyFilter`.
+	onlyNone            bool
+	excludeFieldFilters map[int][]*filterNode
+	filterCombineMode   FilterCombineMode
+	cacheVaryFunc       func(ctx context.Context) string
+	cache               Cacher
+	exec                Executor
+	maxConcurrency      int
+	parallelChunkSize   int
+	panicPolicy         PanicPolicy
+	shedding            bool
+	shedMaxWait         time.Duration
+	shedReport          *[]string
+	shedReportMu        sync.Mutex
 
 	// custom field tags
 	customFieldTagMap map[string]string
@@ -70,18 +85,58 @@ func (c *Chell) DumpWithContext(ctx context.Context, dst, src interface{}) error
 		return errors.New("dst must be a pointer")
 	}
 
+	if !runningDumps.enter() {
+		return errors.WithStack(ErrShutdown)
+	}
+	defer runningDumps.exit()
+
+	// methods see the cancellation when the dump fails.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ctx = withCacheVaryFunc(ctx, c.cacheVaryFunc)
+	ctx = withCacher(ctx, c.cache)
+	if c.maxConcurrency > 0 && concurrencyLimiterFromContext(ctx) == nil {
+		ctx = withConcurrencyLimiter(ctx, newConcurrencyLimiter(c.maxConcurrency))
+	}
+	if c.shedding {
+		shed := &shedPolicy{maxWait: c.shedMaxWait}
+		ctx = withShedPolicy(ctx, shed)
+		defer c.reportShedFields(ctx, shed)
+	}
+
+	var err error
 	if reflect.Indirect(rv).Kind() == reflect.Slice {
-		return c.dumpMany(
-			ctx, dst, src,
-			extractFilterNodeNames(c.onlyFieldFilters[0], nil),
-			extractFilterNodeNames(c.excludeFieldFilters[0], &extractOption{ignoreNodeWithChildren: true}),
-			"",
-		)
+		err = c.dumpMany(ctx, dst, src, c.rootSelection(), "")
 	} else {
-		toSchema := newSchema(dst).withFieldAliasMapTagName(c.fieldAliasMapTagName)
-		toSchema.setOnlyFields(extractFilterNodeNames(c.onlyFieldFilters[0], nil)...)
-		toSchema.setExcludeFields(extractFilterNodeNames(c.excludeFieldFilters[0], &extractOption{ignoreNodeWithChildren: true})...)
-		return c.dump(incrDumpDepthContext(ctx), toSchema, src)
+		toSchema := c.newSchema(ctx, dst)
+		toSchema.selectFields(c.rootSelection())
+		err = c.dump(incrDumpDepthContext(ctx), toSchema, src)
+	}
+
+	if panicErr, ok := errors.Cause(err).(*PanicError); ok && c.panicPolicy == PanicRepanic {
+		// panics on the caller goroutine, wherever the panic happened.
+		panic(panicErr)
+	}
+	return err
+}
+
+// reportShedFields appends the fields shed by a dump to the report of the
+// option `ShedOptionalFields` and the one of `WithShedReport`, dumps of a Chell
+// may run concurrently.
+func (c *Chell) reportShedFields(ctx context.Context, shed *shedPolicy) {
+	fields := shed.shedFields()
+	if len(fields) == 0 {
+		return
+	}
+
+	if r := shedReportFromContext(ctx); r != nil {
+		r.add(fields)
+	}
+	if c.shedReport != nil {
+		c.shedReportMu.Lock()
+		*c.shedReport = append(*c.shedReport, fields...)
+		c.shedReportMu.Unlock()
 	}
 }
 
@@ -98,6 +153,7 @@ func (c *Chell) SetOnlyFields(fields ...string) error {
 		return errors.WithStack(err)
 	} else {
 		c.onlyFieldFilters = filters
+		c.onlyNone = false
 	}
 	return nil
 }
@@ -119,34 +175,67 @@ func (c *Chell) SetExcludeFields(fields ...string) error {
 	return nil
 }
 
-func (c *Chell) dump(ctx context.Context, dst *schema, src interface{}) error {
-	// read custom field tags
-	for _, field := range dst.fields {
+// executor returns the executor set by option `WithExecutor` or `WithWorkerPool`,
+// or the global pool.
+func (c *Chell) executor() Executor {
+	if c.exec != nil {
+		return c.exec
+	}
+	return defaultPool
+}
+
+// newSchema creates a schema to dump to, it uses the request cache
+// attached to ctx if any.
+func (c *Chell) newSchema(ctx context.Context, v interface{}) *schema {
+	return newSchema(v).
+		withFieldAliasMapTagName(c.fieldAliasMapTagName).
+		withCacheGroup(requestCacheGroupFromContext(ctx))
+}
+
+// applyCustomFieldTags overrides field tags with the custom field tags.
+func (c *Chell) applyCustomFieldTags(s *schema) {
+	for _, field := range s.fields {
 		key := fmt.Sprintf("%s.%s", field.schema.name(), field.Name())
 		if v, ok := c.customFieldTagMap[key]; ok {
 			field.settings = parseTagSettings(v)
 		}
 	}
+}
+
+func (c *Chell) dump(ctx context.Context, dst *schema, src interface{}) error {
+	c.applyCustomFieldTags(dst)
 
-	err := c.dumpSyncFields(ctx, dst, src)
+	stages, err := dst.stages()
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	err = c.dumpAsyncFields(ctx, dst, src)
-	if err != nil {
-		return errors.WithStack(err)
+	defer dst.clearDependencyOnlyFields()
+
+	// fields of a stage may read the values of fields dumped by previous stages.
+	for _, fields := range stages {
+		syncFields, asyncFields := splitFields(fields, c.disableConcurrency)
+		err = c.dumpSyncFields(ctx, dst, src, syncFields)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = c.dumpAsyncFields(ctx, dst, src, asyncFields)
+		if err != nil {
+			return errors.WithStack(err)
+		}
 	}
-	return err
+	return nil
 }
 
-func (c *Chell) dumpSyncFields(ctx context.Context, dst *schema, src interface{}) error {
-	syncFields := dst.syncFields(c.disableConcurrency)
+func (c *Chell) dumpSyncFields(ctx context.Context, dst *schema, src interface{}, syncFields []*schemaField) error {
 	if len(syncFields) == 0 {
 		return nil
 	}
 
 	logger.Debugf("[portal.chell] dump sync fields: %s", syncFields)
 	for _, field := range syncFields {
+		if err := ctx.Err(); err != nil {
+			return errors.WithStack(err)
+		}
 		logger.Debugf("[portal.chell] processing sync field '%s'", field)
 		val, err := dst.fieldValueFromSrc(ctx, field, src, c.disableCache)
 		if err != nil {
@@ -162,8 +251,7 @@ func (c *Chell) dumpSyncFields(ctx context.Context, dst *schema, src interface{}
 	return nil
 }
 
-func (c *Chell) dumpAsyncFields(ctx context.Context, dst *schema, src interface{}) error {
-	asyncFields := dst.asyncFields(c.disableConcurrency)
+func (c *Chell) dumpAsyncFields(ctx context.Context, dst *schema, src interface{}, asyncFields []*schemaField) error {
 	if len(asyncFields) == 0 {
 		return nil
 	}
@@ -174,19 +262,16 @@ func (c *Chell) dumpAsyncFields(ctx context.Context, dst *schema, src interface{
 		data  interface{}
 	}
 
-	type Payload struct {
-		field *schemaField
-	}
-
 	workerPayloads := make([]interface{}, 0, len(asyncFields))
 	for _, field := range asyncFields {
-		workerPayloads = append(workerPayloads, &Payload{field: field})
+		workerPayloads = append(workerPayloads, &asyncFieldPayload{field: field})
 	}
 
-	jobResults, err := submitJobs(
+	jobResults, err := submitJobsTo(
 		ctx,
-		func(payload interface{}) (interface{}, error) {
-			p := payload.(*Payload)
+		c.executor(),
+		func(ctx context.Context, payload interface{}) (interface{}, error) {
+			p := payload.(*asyncFieldPayload)
 			logger.Debugf("[portal.chell] processing async field '%s'", p.field)
 			val, err := dst.fieldValueFromSrc(ctx, p.field, src, c.disableCache)
 			logger.Debugf("[portal.chell] async field '%s' got value '%v'", p.field, val)
@@ -201,17 +286,40 @@ func (c *Chell) dumpAsyncFields(ctx context.Context, dst *schema, src interface{
 		if jobResult.Err != nil {
 			return errors.WithStack(jobResult.Err)
 		}
+		if jobResult.Shed {
+			field := jobResult.Data.(*asyncFieldPayload).field
+			logger.Debugf("[portal.chell] optional field '%s' is shed", field)
+			shedPolicyFromContext(ctx).record(fieldPath(ctx, field))
+			if field.hasDefaultValue() {
+				err = c.dumpField(ctx, field, nil)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+			}
+			continue
+		}
 
 		result := jobResult.Data.(*Result)
-		e := c.dumpField(ctx, result.field, result.data)
-		if e != nil {
+		err = c.dumpField(ctx, result.field, result.data)
+		if err != nil {
 			return errors.WithStack(err)
 		}
 	}
 	return nil
 }
 
-func (c *Chell) dumpField(ctx context.Context, field *schemaField, value interface{}) error {
+// asyncFieldPayload is the payload of jobs dumping async fields.
+type asyncFieldPayload struct {
+	field *schemaField
+}
+
+func (p *asyncFieldPayload) optional() bool {
+	return p.field.isOptional()
+}
+
+func (c *Chell) dumpField(ctx context.Context, field *schemaField, value interface{}) (err error) {
+	defer recoverFieldPanic(ctx, field, &err)
+
 	if isNil(value) {
 		if field.hasDefaultValue() {
 			value = field.defaultValue()
@@ -226,6 +334,7 @@ func (c *Chell) dumpField(ctx context.Context, field *schemaField, value interfa
 		logger.Debugf("[portal.chell] dump normal field %s with value '%v'", field, value)
 		return field.setValue(value)
 	} else {
+		ctx = withFieldPath(ctx, field)
 		if field.hasMany() {
 			logger.Debugf("[portal.chell] dump nested slice field %s with value '%v'", field, value)
 			return c.dumpFieldNestedMany(ctx, field, value)
@@ -238,11 +347,9 @@ func (c *Chell) dumpField(ctx context.Context, field *schemaField, value interfa
 
 func (c *Chell) dumpFieldNestedOne(ctx context.Context, field *schemaField, src interface{}) error {
 	val := reflect.New(indirectStructTypeP(reflect.TypeOf(field.Value())))
-	toNestedSchema := newSchema(val.Interface()).withFieldAliasMapTagName(c.fieldAliasMapTagName)
+	toNestedSchema := c.newSchema(ctx, val.Interface())
 
-	depth := dumpDepthFromContext(ctx)
-	toNestedSchema.setOnlyFields(field.nestedOnlyNames(c.onlyFieldFilters[depth])...)
-	toNestedSchema.setExcludeFields(field.nestedExcludeNames(c.excludeFieldFilters[depth])...)
+	toNestedSchema.selectFields(c.nestedSelection(ctx, field))
 	err := c.dump(incrDumpDepthContext(ctx), toNestedSchema, src)
 	if err != nil {
 		return err
@@ -260,15 +367,7 @@ func (c *Chell) dumpFieldNestedOne(ctx context.Context, field *schemaField, src
 func (c *Chell) dumpFieldNestedMany(ctx context.Context, field *schemaField, src interface{}) error {
 	typ := reflect.TypeOf(field.Value())
 	nestedSchemaSlice := reflect.New(typ)
-	depth := dumpDepthFromContext(ctx)
-	err := c.dumpMany(
-		ctx,
-		nestedSchemaSlice.Interface(),
-		src,
-		field.nestedOnlyNames(c.onlyFieldFilters[depth]),
-		field.nestedExcludeNames(c.excludeFieldFilters[depth]),
-		field.String(),
-	)
+	err := c.dumpMany(ctx, nestedSchemaSlice.Interface(), src, c.nestedSelection(ctx, field), field.String())
 	if err != nil {
 		return err
 	}
@@ -288,7 +387,28 @@ func (c *Chell) dumpFieldNestedMany(ctx context.Context, field *schemaField, src
 	return nil
 }
 
-func (c *Chell) dumpMany(ctx context.Context, dst, src interface{}, onlyFields, excludeFields []string, field string) error {
+// rootSelection selects fields of the schema to dump by the runtime filters.
+func (c *Chell) rootSelection() *fieldSelection {
+	return &fieldSelection{
+		only:    extractFilterNodeNames(c.onlyFieldFilters[0], nil),
+		exclude: extractFilterNodeNames(c.excludeFieldFilters[0], &extractOption{ignoreNodeWithChildren: true}),
+		none:    c.onlyNone,
+	}
+}
+
+// nestedSelection selects fields of the nested schema of field by the runtime
+// filters and the tag settings.
+func (c *Chell) nestedSelection(ctx context.Context, field *schemaField) *fieldSelection {
+	depth := dumpDepthFromContext(ctx)
+	only, none := field.nestedOnlyNames(c.onlyFieldFilters[depth-1], c.onlyFieldFilters[depth], c.filterCombineMode)
+	return &fieldSelection{
+		only:    only,
+		exclude: field.nestedExcludeNames(c.excludeFieldFilters[depth], c.filterCombineMode),
+		none:    none,
+	}
+}
+
+func (c *Chell) dumpMany(ctx context.Context, dst, src interface{}, sel *fieldSelection, field string) error {
 	rv := reflect.ValueOf(src)
 	if rv.Kind() == reflect.Ptr {
 		rv = reflect.Indirect(rv)
@@ -306,62 +426,53 @@ func (c *Chell) dumpMany(ctx context.Context, dst, src interface{}, onlyFields,
 	schemaSlice.Set(reflect.MakeSlice(schemaSlice.Type(), rv.Len(), rv.Cap()))
 	schemaType := indirectStructTypeP(schemaSlice.Type())
 
-	if c.disableConcurrency || !hasAsyncFields(schemaType, onlyFields, excludeFields) {
-		return c.dumpManySynchronously(ctx, schemaType, schemaSlice, rv, onlyFields, excludeFields)
+	ctx, batch := c.prefetch(ctx, schemaType, rv, sel)
+	var err error
+	switch {
+	case c.disableConcurrency:
+		err = c.dumpManySynchronously(ctx, schemaType, schemaSlice, rv, sel)
+	case c.parallelChunkSize > 0:
+		err = c.dumpManyConcurrently(ctx, schemaType, schemaSlice, rv, sel, c.parallelChunkSize)
+	case !sel.none && hasAsyncFields(schemaType, sel.only, sel.exclude):
+		err = c.dumpManyConcurrently(ctx, schemaType, schemaSlice, rv, sel, 1)
+	default:
+		err = c.dumpManySynchronously(ctx, schemaType, schemaSlice, rv, sel)
+	}
+	if err != nil {
+		return err
 	}
 
-	return c.dumpManyConcurrently(ctx, schemaType, schemaSlice, rv, onlyFields, excludeFields)
-}
-
-func (c *Chell) dumpManySynchronously(ctx context.Context, schemaType reflect.Type, dst, src reflect.Value, onlyFields, excludeFields []string) error {
-	logger.Debugf("[portal.dumpManySynchronously] '%s' -> '%s'", src.Type().String(), dst.Type().String())
-	for i := 0; i < src.Len(); i++ {
-		schemaPtr := reflect.New(schemaType)
-		toSchema := newSchema(schemaPtr.Interface()).withFieldAliasMapTagName(c.fieldAliasMapTagName)
-		toSchema.setOnlyFields(onlyFields...)
-		toSchema.setExcludeFields(excludeFields...)
-		val := src.Index(i).Interface()
-		err := c.dump(incrDumpDepthContext(ctx), toSchema, val)
-		if err != nil {
-			return errors.WithStack(err)
-		}
-
-		elem := dst.Index(i)
-		switch elem.Kind() {
-		case reflect.Struct:
-			elem.Set(reflect.Indirect(schemaPtr))
-		case reflect.Ptr:
-			elem.Set(schemaPtr)
-		default:
-			return errors.Errorf("unsupported schema field type '%s', expected a struct or a pointer to struct", elem.Type().Kind())
-		}
+	if batch != nil {
+		return batch.flush(ctx)
 	}
 	return nil
 }
 
-func (c *Chell) dumpManyConcurrently(ctx context.Context, schemaType reflect.Type, dst, src reflect.Value, onlyFields, excludeFields []string) error {
-	logger.Debugf("[portal.dumpManyConcurrently] '%s' -> '%s'", src.Type().String(), dst.Type().String())
-	type Result struct {
-		index     int
-		schemaPtr reflect.Value
-	}
+func (c *Chell) dumpManySynchronously(ctx context.Context, schemaType reflect.Type, dst, src reflect.Value, sel *fieldSelection) error {
+	logger.Debugf("[portal.dumpManySynchronously] '%s' -> '%s'", src.Type().String(), dst.Type().String())
+	return c.dumpElements(ctx, schemaType, dst, src, 0, src.Len(), sel)
+}
 
-	payloads := make([]interface{}, 0, src.Len())
-	for i := 0; i < src.Len(); i++ {
+// dumpManyConcurrently dumps elements in parallel, each job dumps a chunk of
+// chunkSize elements sequentially.
+func (c *Chell) dumpManyConcurrently(ctx context.Context, schemaType reflect.Type, dst, src reflect.Value, sel *fieldSelection, chunkSize int) error {
+	logger.Debugf("[portal.dumpManyConcurrently] '%s' -> '%s' in chunks of %d", src.Type().String(), dst.Type().String(), chunkSize)
+	payloads := make([]interface{}, 0, (src.Len()+chunkSize-1)/chunkSize)
+	for i := 0; i < src.Len(); i += chunkSize {
 		payloads = append(payloads, i)
 	}
 
-	jobResults, err := submitJobs(
+	jobResults, err := submitJobsTo(
 		ctx,
-		func(payload interface{}) (interface{}, error) {
-			index := payload.(int)
-			schemaPtr := reflect.New(schemaType)
-			toSchema := newSchema(schemaPtr.Interface()).withFieldAliasMapTagName(c.fieldAliasMapTagName)
-			toSchema.setOnlyFields(onlyFields...)
-			toSchema.setExcludeFields(excludeFields...)
-			val := src.Index(index).Interface()
-			err := c.dump(incrDumpDepthContext(ctx), toSchema, val)
-			return &Result{index: index, schemaPtr: schemaPtr}, err
+		c.executor(),
+		func(ctx context.Context, payload interface{}) (interface{}, error) {
+			start := payload.(int)
+			end := start + chunkSize
+			if end > src.Len() {
+				end = src.Len()
+			}
+			// jobs set different elements of dst.
+			return nil, c.dumpElements(ctx, schemaType, dst, src, start, end, sel)
 		},
 		payloads...)
 	if err != nil {
@@ -372,14 +483,34 @@ func (c *Chell) dumpManyConcurrently(ctx context.Context, schemaType reflect.Typ
 		if jobResult.Err != nil {
 			return errors.WithStack(jobResult.Err)
 		}
+	}
+	return nil
+}
+
+// dumpElements dumps elements of src in [start, end) to dst.
+func (c *Chell) dumpElements(ctx context.Context, schemaType reflect.Type, dst, src reflect.Value, start, end int, sel *fieldSelection) error {
+	for i := start; i < end; i++ {
+		if err := ctx.Err(); err != nil {
+			return errors.WithStack(err)
+		}
 
-		r := jobResult.Data.(*Result)
-		elem := dst.Index(r.index)
+		schemaPtr := reflect.New(schemaType)
+		toSchema := c.newSchema(ctx, schemaPtr.Interface())
+		toSchema.selectFields(sel)
+		val := src.Index(i).Interface()
+		err := c.dump(incrDumpDepthContext(ctx), toSchema, val)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		elem := dst.Index(i)
 		switch elem.Kind() {
 		case reflect.Struct:
-			elem.Set(reflect.Indirect(r.schemaPtr))
+			elem.Set(reflect.Indirect(schemaPtr))
 		case reflect.Ptr:
-			elem.Set(r.schemaPtr)
+			elem.Set(schemaPtr)
+		default:
+			return errors.Errorf("unsupported schema field type '%s', expected a struct or a pointer to struct", elem.Type().Kind())
 		}
 	}
 	return nil
@@ -254,3 +254,29 @@ func BenchmarkDumpManyWithoutCache(b *testing.B) {
 		_ = Dump(&schemas, hogwarts)
 	}
 }
+
+func benchmarkDumpManyElements(b *testing.B, opts ...option) {
+	products := makeProducts(1000)
+	opts = append(opts, Exclude("Company"), DisableCache())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var schemas []*ProductSchema
+		_ = Dump(&schemas, products, opts...)
+	}
+}
+
+// BenchmarkDumpManyElementsSequentially-4   	      20	  12564304 ns/op
+func BenchmarkDumpManyElementsSequentially(b *testing.B) {
+	benchmarkDumpManyElements(b)
+}
+
+// BenchmarkDumpManyElementsPerJob-4   	      20	  17498596 ns/op
+func BenchmarkDumpManyElementsPerJob(b *testing.B) {
+	benchmarkDumpManyElements(b, ParallelElements(1))
+}
+
+// BenchmarkDumpManyElementsInChunks-4   	      20	  15466900 ns/op
+func BenchmarkDumpManyElementsInChunks(b *testing.B) {
+	benchmarkDumpManyElements(b, ParallelElements(64))
+}
@@ -201,7 +201,7 @@ func TestDumpError(t *testing.T) {
 
 	err := Dump(&dst, &task, Only("Title", "Desc["))
 	assert.NotNil(t, err)
-	assert.Equal(t, errUnmatchedBrackets.Error(), err.Error())
+	assert.Equal(t, ErrUnmatchedBrackets, filterSyntaxCause(err))
 
 	err = Dump(&dst, &task, Only("Desc"))
 	assert.NotNil(t, err)
@@ -244,3 +244,96 @@ func TestChellBoundaryConditions(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Equal(t, "dst must be a pointer", err.Error())
 }
+
+func TestDumpWithFilter(t *testing.T) {
+	task := TaskModel{
+		ID:     1,
+		UserID: 1,
+		Title:  "Finish your jobs.",
+	}
+
+	defaults, err := ParseFilter("ID,Title")
+	assert.Nil(t, err)
+	requested, err := ParseFilter("User[Name]")
+	assert.Nil(t, err)
+
+	var taskSchema TaskSchema
+	err = Dump(&taskSchema, &task, OnlyFilter(defaults.Merge(requested)))
+	assert.Nil(t, err)
+	data, _ := json.Marshal(taskSchema)
+	assert.Equal(t, `{"id":"1","title":"Finish your jobs.","user":{"name":"user:1"},"unknown":""}`, string(data))
+
+	excluded, err := ParseFilter("Description,User,SimpleUser,Unknown")
+	assert.Nil(t, err)
+	var taskSchema2 TaskSchema
+	err = Dump(&taskSchema2, &task, ExcludeFilter(excluded))
+	assert.Nil(t, err)
+	data, _ = json.Marshal(taskSchema2)
+	assert.Equal(t, `{"id":"1","title":"Finish your jobs.","unknown":""}`, string(data))
+}
+
+func TestDumpCombineTagFilter(t *testing.T) {
+	task := TaskModel{
+		ID:     1,
+		UserID: 1,
+		Title:  "Finish your jobs.",
+	}
+
+	cases := []struct {
+		mode     FilterCombineMode
+		only     string
+		expected string
+	}{
+		{FilterOverrideTag, "SimpleUser[ID]", `{"simple_user":{"id":"1"},"unknown":""}`},
+		{FilterMergeTag, "SimpleUser[id]", `{"simple_user":{"id":"1","name":"user:1"},"unknown":""}`},
+		{FilterIntersectTag, "SimpleUser[ID]", `{"simple_user":{},"unknown":""}`},
+		{FilterIntersectTag, "SimpleUser[ID,name]", `{"simple_user":{"name":"user:1"},"unknown":""}`},
+		{FilterIntersectTag, "SimpleUser", `{"simple_user":{"name":"user:1"},"unknown":""}`},
+		{FilterOverrideTag, "SimpleUser[]", `{"simple_user":{},"unknown":""}`},
+		{FilterMergeTag, "SimpleUser[]", `{"simple_user":{"name":"user:1"},"unknown":""}`},
+		{FilterIntersectTag, "SimpleUser[]", `{"simple_user":{},"unknown":""}`},
+	}
+
+	for _, c := range cases {
+		var taskSchema TaskSchema
+		err := Dump(&taskSchema, &task, Only(c.only), CombineTagFilter(c.mode))
+		assert.Nil(t, err)
+		data, _ := json.Marshal(taskSchema)
+		assert.Equal(t, c.expected, string(data), c.only)
+	}
+}
+
+func TestDump_FieldDependencies(t *testing.T) {
+	student := &Student{ID: 1, FirstName: "Harry", LastName: "Potter"}
+	expected := DependentSchema{FullName: "Harry Potter", Greeting: "Hello, Harry Potter", FirstName: "Harry", LastName: "Potter", ID: 1}
+
+	var dst DependentSchema
+	assert.Nil(t, Dump(&dst, student))
+	assert.Equal(t, expected, dst)
+
+	var dst2 DependentSchema
+	assert.Nil(t, Dump(&dst2, student, DisableConcurrency()))
+	assert.Equal(t, expected, dst2)
+
+	var many []*DependentSchema
+	assert.Nil(t, Dump(&many, []*Student{student, {ID: 2, FirstName: "Ron", LastName: "Weasley"}}))
+	assert.Equal(t, "Hello, Ron Weasley", many[1].Greeting)
+
+	// dependencies hidden by the filters are resolved but never dumped
+	var only DependentSchema
+	assert.Nil(t, Dump(&only, student, Only("Greeting")))
+	assert.Equal(t, DependentSchema{Greeting: "Hello, Harry Potter"}, only)
+
+	var excluded DependentSchema
+	assert.Nil(t, Dump(&excluded, student, Exclude("first_name", "LastName")))
+	assert.Equal(t, DependentSchema{FullName: "Harry Potter", Greeting: "Hello, Harry Potter", ID: 1}, excluded)
+
+	var excludedMany []*DependentSchema
+	assert.Nil(t, Dump(&excludedMany, []*Student{student}, Exclude("first_name", "LastName")))
+	assert.Equal(t, &excluded, excludedMany[0])
+
+	var cyclic CyclicSchema
+	err := Dump(&cyclic, student)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "cyclic field dependencies")
+}
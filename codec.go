@@ -0,0 +1,174 @@
+package portal
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Codec serializes cached values for byte-oriented stores, e.g. the remote
+// tier of TieredCache. Unmarshal must return a value of the same type as the one
+// marshaled, so that it can be converted to the schema field like a fresh result.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte) (interface{}, error)
+}
+
+var (
+	// JSONCodec encodes values as JSON along with the registered type names.
+	JSONCodec Codec = jsonCodec{}
+	// GobCodec encodes values with encoding/gob.
+	GobCodec Codec = gobCodec{}
+)
+
+var cacheTypeRegistry sync.Map
+
+func init() {
+	RegisterCacheType(
+		false, "", []byte(nil), []string(nil), []int(nil), []int64(nil), time.Time{},
+		int(0), int8(0), int16(0), int32(0), int64(0),
+		uint(0), uint8(0), uint16(0), uint32(0), uint64(0),
+		float32(0), float64(0),
+		map[string]interface{}(nil), []interface{}(nil),
+	)
+}
+
+// RegisterCacheType registers types of method results cached in byte-oriented
+// stores, they must be registered before decoding. Builtin types are registered.
+// Example:
+// ```
+// portal.RegisterCacheType(&model.UserModel{}, []*model.TaskModel{})
+// ```
+func RegisterCacheType(values ...interface{}) {
+	for _, v := range values {
+		typ := reflect.TypeOf(v)
+		cacheTypeRegistry.Store(cacheTypeName(typ), typ)
+		gobRegister(v)
+	}
+}
+
+func gobRegister(v interface{}) {
+	defer func() {
+		// registered by gob already with another name.
+		if r := recover(); r != nil {
+			logger.Debugf("[portal.codec] gob register '%T': %v", v, r)
+		}
+	}()
+	gob.Register(v)
+}
+
+func cacheTypeName(typ reflect.Type) string {
+	if typ.Kind() == reflect.Ptr {
+		return "*" + cacheTypeName(typ.Elem())
+	}
+	if typ.Name() != "" && typ.PkgPath() != "" {
+		return typ.PkgPath() + "." + typ.Name()
+	}
+	return typ.String()
+}
+
+func lookupCacheType(name string) (reflect.Type, bool) {
+	typ, ok := cacheTypeRegistry.Load(name)
+	if !ok {
+		return nil, false
+	}
+	return typ.(reflect.Type), true
+}
+
+type jsonCodec struct{}
+
+type jsonEnvelope struct {
+	Type  string          `json:"t,omitempty"`
+	Value json.RawMessage `json:"v,omitempty"`
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	if v == nil {
+		return json.Marshal(jsonEnvelope{})
+	}
+
+	name := cacheTypeName(reflect.TypeOf(v))
+	if _, ok := lookupCacheType(name); !ok {
+		return nil, errors.Errorf("cache type '%s' is not registered", name)
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return json.Marshal(jsonEnvelope{Type: name, Value: data})
+}
+
+func (jsonCodec) Unmarshal(data []byte) (interface{}, error) {
+	var envelope jsonEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if envelope.Type == "" {
+		return nil, nil
+	}
+
+	typ, ok := lookupCacheType(envelope.Type)
+	if !ok {
+		return nil, errors.Errorf("cache type '%s' is not registered", envelope.Type)
+	}
+
+	ptr := reflect.New(typ)
+	if err := json.Unmarshal(envelope.Value, ptr.Interface()); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return ptr.Elem().Interface(), nil
+}
+
+type gobCodec struct{}
+
+type gobEnvelope struct {
+	// Type is the registered type name, gob doesn't distinguish
+	// a type from the pointer to it.
+	Type  string
+	Value interface{}
+}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	envelope := &gobEnvelope{}
+	if !isNil(v) {
+		// gob cannot encode nil pointers.
+		envelope.Type = cacheTypeName(reflect.TypeOf(v))
+		envelope.Value = v
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(envelope); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte) (interface{}, error) {
+	var envelope gobEnvelope
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&envelope); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	typ, ok := lookupCacheType(envelope.Type)
+	if !ok || envelope.Value == nil {
+		return envelope.Value, nil
+	}
+
+	rv := reflect.ValueOf(envelope.Value)
+	switch {
+	case typ.Kind() == reflect.Ptr && rv.Type() == typ.Elem():
+		ptr := reflect.New(rv.Type())
+		ptr.Elem().Set(rv)
+		return ptr.Interface(), nil
+	case rv.Kind() == reflect.Ptr && rv.Type().Elem() == typ:
+		return rv.Elem().Interface(), nil
+	default:
+		return envelope.Value, nil
+	}
+}
@@ -0,0 +1,62 @@
+package portal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type codecModel struct {
+	ID   int
+	Name string
+	Tags []string
+}
+
+func TestCodec(t *testing.T) {
+	RegisterCacheType(codecModel{}, &codecModel{}, []*codecModel{})
+
+	now := time.Unix(1570000000, 0).UTC()
+	values := []interface{}{
+		"hello", 42, int64(42), 3.14, true, []string{"a", "b"}, now,
+		codecModel{ID: 1, Name: "a", Tags: []string{"x"}},
+		&codecModel{ID: 2, Name: "b"},
+		[]*codecModel{{ID: 3}, {ID: 4}},
+	}
+	for _, codec := range []Codec{JSONCodec, GobCodec} {
+		for _, v := range values {
+			data, err := codec.Marshal(v)
+			require.Nil(t, err, "%T", v)
+			decoded, err := codec.Unmarshal(data)
+			require.Nil(t, err, "%T", v)
+			assert.Equal(t, v, decoded)
+		}
+
+		data, err := codec.Marshal(nil)
+		require.Nil(t, err)
+		decoded, err := codec.Unmarshal(data)
+		assert.Nil(t, err)
+		assert.Nil(t, decoded)
+	}
+}
+
+func TestJSONCodec_UnregisteredType(t *testing.T) {
+	type unregistered struct{ ID int }
+
+	_, err := JSONCodec.Marshal(&unregistered{ID: 1})
+	assert.EqualError(t, err, "cache type '*github.com/ifaceless/portal.unregistered' is not registered")
+
+	_, err = JSONCodec.Unmarshal([]byte(`{"t":"main.Foo","v":{}}`))
+	assert.EqualError(t, err, "cache type 'main.Foo' is not registered")
+
+	_, err = JSONCodec.Unmarshal([]byte(`invalid`))
+	assert.NotNil(t, err)
+}
+
+func TestGobCodec_UnregisteredType(t *testing.T) {
+	type unregistered struct{ ID int }
+
+	_, err := GobCodec.Marshal(&unregistered{ID: 1})
+	assert.NotNil(t, err)
+}
@@ -6,7 +6,11 @@ type contextKey struct {
 	name string
 }
 
-var dumpDepthCtxKey = contextKey{name: "dump-depth"}
+var (
+	dumpDepthCtxKey     = contextKey{name: "dump-depth"}
+	cacheVaryFuncCtxKey = contextKey{name: "cache-vary-func"}
+	cacherCtxKey        = contextKey{name: "cacher"}
+)
 
 func incrDumpDepthContext(ctx context.Context) context.Context {
 	return context.WithValue(ctx, dumpDepthCtxKey, dumpDepthFromContext(ctx)+1)
@@ -21,3 +25,27 @@ func dumpDepthFromContext(ctx context.Context) int {
 	}
 	return depth
 }
+
+func withCacheVaryFunc(ctx context.Context, fn func(ctx context.Context) string) context.Context {
+	if fn == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, cacheVaryFuncCtxKey, fn)
+}
+
+func cacheVaryFuncFromContext(ctx context.Context) func(ctx context.Context) string {
+	fn, _ := ctx.Value(cacheVaryFuncCtxKey).(func(ctx context.Context) string)
+	return fn
+}
+
+func withCacher(ctx context.Context, c Cacher) context.Context {
+	if c == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, cacherCtxKey, c)
+}
+
+func cacherFromContext(ctx context.Context) Cacher {
+	c, _ := ctx.Value(cacherCtxKey).(Cacher)
+	return c
+}
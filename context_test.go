@@ -16,3 +16,12 @@ func TestDumpDepthContext(t *testing.T) {
 	depth = dumpDepthFromContext(ctx)
 	assert.Equal(t, 1, depth)
 }
+
+func TestCacheVaryFuncContext(t *testing.T) {
+	ctx := context.Background()
+	assert.Nil(t, cacheVaryFuncFromContext(ctx))
+	assert.Equal(t, ctx, withCacheVaryFunc(ctx, nil))
+
+	ctx = withCacheVaryFunc(ctx, func(ctx context.Context) string { return "v" })
+	assert.Equal(t, "v", cacheVaryFuncFromContext(ctx)(ctx))
+}
@@ -16,7 +16,12 @@ import (
 // - from is pointer type，to is value type
 // - from is value type, to is value type
 // - from and to are all pointer type
+// Converters registered by `RegisterConverter` are used first.
 func convert(to, from interface{}) (out interface{}, err error) {
+	if out, ok, err := convertWithRegistry(to, from); ok {
+		return out, err
+	}
+
 	v := from
 	iv := reflect.ValueOf(from)
 	if iv.Type().Kind() == reflect.Ptr {
@@ -157,9 +162,154 @@ func convertWithReflect(to interface{}, from interface{}) (interface{}, error) {
 		return value.Elem().Convert(expectedType).Interface(), nil
 	}
 
+	// slices, arrays and maps -> slices, arrays and maps, element by element
+	if isCollection(indirectType(expectedType)) && isCollection(indirectType(value.Type())) {
+		out, err := convertCollection(expectedType, value)
+		if err != nil {
+			return nil, err
+		}
+		return out.Interface(), nil
+	}
+
 	return nil, fmt.Errorf("failed to convert from type '%s' to '%s'", value.Type().String(), expectedType.String())
 }
 
+func indirectType(typ reflect.Type) reflect.Type {
+	if typ.Kind() == reflect.Ptr {
+		return typ.Elem()
+	}
+	return typ
+}
+
+func isCollection(typ reflect.Type) bool {
+	switch typ.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return true
+	default:
+		return false
+	}
+}
+
+// convertCollection converts slices, arrays and maps (or pointers to them) to typ,
+// keys and elements are converted by `convertElement`, so nested collections
+// are converted recursively.
+func convertCollection(typ reflect.Type, value reflect.Value) (reflect.Value, error) {
+	if value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return reflect.Zero(typ), nil
+		}
+		value = value.Elem()
+	}
+
+	if typ.Kind() == reflect.Ptr {
+		out, err := convertCollection(typ.Elem(), value)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		ptr := reflect.New(typ.Elem())
+		ptr.Elem().Set(out)
+		return ptr, nil
+	}
+
+	switch typ.Kind() {
+	case reflect.Slice:
+		if value.Kind() == reflect.Map {
+			break
+		}
+		if value.Kind() == reflect.Slice && value.IsNil() {
+			return reflect.Zero(typ), nil
+		}
+		out := reflect.MakeSlice(typ, value.Len(), value.Len())
+		for i := 0; i < value.Len(); i++ {
+			elem, err := convertElement(typ.Elem(), value.Index(i))
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("failed to convert element %d: %s", i, err)
+			}
+			out.Index(i).Set(elem)
+		}
+		return out, nil
+	case reflect.Array:
+		if value.Kind() == reflect.Map {
+			break
+		}
+		if value.Len() > typ.Len() {
+			return reflect.Value{}, fmt.Errorf("cannot convert %d elements to '%s'", value.Len(), typ)
+		}
+		out := reflect.New(typ).Elem()
+		for i := 0; i < value.Len(); i++ {
+			elem, err := convertElement(typ.Elem(), value.Index(i))
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("failed to convert element %d: %s", i, err)
+			}
+			out.Index(i).Set(elem)
+		}
+		return out, nil
+	case reflect.Map:
+		if value.Kind() != reflect.Map {
+			break
+		}
+		if value.IsNil() {
+			return reflect.Zero(typ), nil
+		}
+		out := reflect.MakeMapWithSize(typ, value.Len())
+		for _, k := range value.MapKeys() {
+			key, err := convertElement(typ.Key(), k)
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("failed to convert key '%v': %s", k, err)
+			}
+			elem, err := convertElement(typ.Elem(), value.MapIndex(k))
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("failed to convert value of key '%v': %s", k, err)
+			}
+			out.SetMapIndex(key, elem)
+		}
+		return out, nil
+	}
+	return reflect.Value{}, fmt.Errorf("failed to convert from type '%s' to '%s'", value.Type(), typ)
+}
+
+// convertElement converts an element of collections to typ,
+// nil elements are converted to zero values.
+func convertElement(typ reflect.Type, value reflect.Value) (reflect.Value, error) {
+	if value.Kind() == reflect.Interface {
+		value = value.Elem()
+	}
+	if !value.IsValid() || (value.Kind() == reflect.Ptr && value.IsNil()) {
+		return reflect.Zero(typ), nil
+	}
+	if value.Type().AssignableTo(typ) {
+		return value, nil
+	}
+	if typ.Kind() == reflect.Interface {
+		if value.Type().Implements(typ) {
+			return value.Convert(typ), nil
+		}
+		return reflect.Value{}, fmt.Errorf("type '%s' does not implement '%s'", value.Type(), typ)
+	}
+
+	out, err := convert(reflect.Zero(typ).Interface(), value.Interface())
+	if err != nil {
+		// elements like models, e.g. []*UserModel -> []int
+		if valuer, ok := value.Interface().(Valuer); ok {
+			v, e := valuer.Value()
+			if e != nil {
+				return reflect.Value{}, e
+			}
+			return convertElement(typ, reflect.ValueOf(v))
+		}
+		return reflect.Value{}, err
+	}
+
+	ov := reflect.ValueOf(out)
+	if !ov.IsValid() {
+		return reflect.Zero(typ), nil
+	}
+	if !ov.Type().AssignableTo(typ) {
+		return reflect.Value{}, fmt.Errorf("failed to convert from type '%s' to '%s'", value.Type(), typ)
+	}
+	return ov, nil
+}
+
 func toIntPtrE(v interface{}) (*int, error) {
 	cv, err := cast.ToIntE(v)
 	if err != nil {
@@ -835,3 +835,103 @@ func Test_convertWithReflect(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, int64(10), *ret.(*int64))
 }
+
+type idModel struct {
+	ID uint64
+}
+
+func (m *idModel) Value() (interface{}, error) {
+	return m.ID, nil
+}
+
+func Test_convertCollections(t *testing.T) {
+	// slices
+	out, err := convert([]string(nil), []int64{1, 2, 3})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1", "2", "3"}, out)
+
+	out, err = convert([]float32(nil), []string{"1.5", "2"})
+	assert.Nil(t, err)
+	assert.Equal(t, []float32{1.5, 2}, out)
+
+	// pointer elements
+	one, two := int64(1), int64(2)
+	out, err = convert([]*string(nil), []*int64{&one, nil, &two})
+	assert.Nil(t, err)
+	ptrs := out.([]*string)
+	assert.Equal(t, "1", *ptrs[0])
+	assert.Nil(t, ptrs[1])
+	assert.Equal(t, "2", *ptrs[2])
+
+	// models to ids
+	out, err = convert([]uint64(nil), []*idModel{{ID: 1}, {ID: 2}})
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{1, 2}, out)
+
+	// arrays
+	out, err = convert([3]string{}, []int{1, 2})
+	assert.Nil(t, err)
+	assert.Equal(t, [3]string{"1", "2", ""}, out)
+
+	out, err = convert([]int(nil), [2]string{"1", "2"})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, 2}, out)
+
+	_, err = convert([1]string{}, []int{1, 2})
+	assert.NotNil(t, err)
+
+	// maps
+	out, err = convert(map[string]string(nil), map[int64]float32{1: 1.5})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"1": "1.5"}, out)
+
+	out, err = convert(map[int]*string(nil), map[string]int{"1": 1})
+	assert.Nil(t, err)
+	assert.Equal(t, "1", *out.(map[int]*string)[1])
+
+	// nested collections
+	out, err = convert([][]string(nil), [][]int64{{1}, {2, 3}})
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{{"1"}, {"2", "3"}}, out)
+
+	out, err = convert(map[string][]int(nil), map[int][]string{1: {"1", "2"}})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]int{"1": {1, 2}}, out)
+
+	// pointers to collections
+	out, err = convert(&[]string{}, &[]int64{1})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1"}, *out.(*[]string))
+
+	// nil collections
+	out, err = convert([]string(nil), []int64(nil))
+	assert.Nil(t, err)
+	assert.Nil(t, out)
+
+	// invalid elements
+	_, err = convert([]int(nil), []string{"1", "a"})
+	assert.NotNil(t, err)
+}
+
+type collectionModel struct {
+	IDs    []int64
+	Scores map[int64]float32
+	Users  []*idModel
+}
+
+type CollectionSchema struct {
+	IDs     []string          `portal:"attr:IDs"`
+	Scores  map[string]string `portal:"attr:Scores"`
+	UserIDs []uint64          `portal:"attr:Users"`
+}
+
+func TestDump_ConvertCollections(t *testing.T) {
+	var dst CollectionSchema
+	err := Dump(&dst, &collectionModel{
+		IDs:    []int64{1, 2},
+		Scores: map[int64]float32{1: 0.5},
+		Users:  []*idModel{{ID: 3}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, CollectionSchema{IDs: []string{"1", "2"}, Scores: map[string]string{"1": "0.5"}, UserIDs: []uint64{3}}, dst)
+}
@@ -0,0 +1,132 @@
+package portal
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// ConvertFunc converts a value to another type.
+type ConvertFunc func(v interface{}) (interface{}, error)
+
+type converterKey struct {
+	from, to reflect.Type
+}
+
+var (
+	converters     sync.Map
+	converterCount int32
+
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// RegisterConverter registers fn converting values of type from to type to,
+// from and to are values of the types, or reflect.Type for interface types.
+// Registered converters are used before the builtin conversions, and also
+// convert pointers of from to to, or to pointers of to.
+// Example:
+// ```
+// portal.RegisterConverter(model.UserID(0), "", func(v interface{}) (interface{}, error) {
+// return v.(model.UserID).String(), nil
+// })
+// ```
+func RegisterConverter(from, to interface{}, fn ConvertFunc) {
+	key := converterKey{from: typeOf(from), to: typeOf(to)}
+	if _, loaded := converters.LoadOrStore(key, fn); loaded {
+		converters.Store(key, fn)
+		return
+	}
+	atomic.AddInt32(&converterCount, 1)
+}
+
+// RegisterConverterFunc registers a typed converter function, it's a helper of
+// `RegisterConverter` which infers the types from the function signature.
+// The function must be like `func(From) To` or `func(From) (To, error)`.
+// Example:
+// ```
+// portal.RegisterConverterFunc(func(m model.Money) string { return m.Format() })
+// portal.RegisterConverterFunc(func(s string) (model.Status, error) { return model.ParseStatus(s) })
+// ```
+func RegisterConverterFunc(fn interface{}) error {
+	fv := reflect.ValueOf(fn)
+	ft := fv.Type()
+	if ft.Kind() != reflect.Func || ft.NumIn() != 1 || ft.NumOut() < 1 || ft.NumOut() > 2 ||
+		(ft.NumOut() == 2 && ft.Out(1) != errorType) {
+		return errors.Errorf("invalid converter '%s', expected func(From) To or func(From) (To, error)", ft)
+	}
+
+	from := ft.In(0)
+	RegisterConverter(from, ft.Out(0), func(v interface{}) (interface{}, error) {
+		in := reflect.ValueOf(v)
+		if !in.IsValid() {
+			in = reflect.Zero(from)
+		}
+		outs := fv.Call([]reflect.Value{in})
+		if len(outs) == 2 && !outs[1].IsNil() {
+			return nil, outs[1].Interface().(error)
+		}
+		return outs[0].Interface(), nil
+	})
+	return nil
+}
+
+func typeOf(v interface{}) reflect.Type {
+	if typ, ok := v.(reflect.Type); ok {
+		return typ
+	}
+	return reflect.TypeOf(v)
+}
+
+func lookupConverter(from, to reflect.Type) (ConvertFunc, bool) {
+	fn, ok := converters.Load(converterKey{from: from, to: to})
+	if !ok {
+		return nil, false
+	}
+	return fn.(ConvertFunc), true
+}
+
+// convertWithRegistry converts from with the registered converters,
+// ok is false if no converter is found.
+func convertWithRegistry(to, from interface{}) (out interface{}, ok bool, err error) {
+	if atomic.LoadInt32(&converterCount) == 0 || to == nil || from == nil {
+		return nil, false, nil
+	}
+
+	toType := reflect.TypeOf(to)
+	fromValue := reflect.ValueOf(from)
+	candidates := []reflect.Value{fromValue}
+	if fromValue.Kind() == reflect.Ptr && !fromValue.IsNil() {
+		candidates = append(candidates, fromValue.Elem())
+	}
+
+	for _, v := range candidates {
+		if fn, found := lookupConverter(v.Type(), toType); found {
+			out, err = fn(v.Interface())
+			return out, true, errors.WithStack(err)
+		}
+	}
+
+	// value converters also convert to pointers.
+	if toType.Kind() == reflect.Ptr {
+		for _, v := range candidates {
+			if fn, found := lookupConverter(v.Type(), toType.Elem()); found {
+				out, err = fn(v.Interface())
+				if err != nil {
+					return nil, true, errors.WithStack(err)
+				}
+				ptr := reflect.New(toType.Elem())
+				if out != nil {
+					ov := reflect.ValueOf(out)
+					if !ov.Type().AssignableTo(toType.Elem()) {
+						return nil, true, errors.Errorf("converter returns '%s', expected '%s'", ov.Type(), toType.Elem())
+					}
+					ptr.Elem().Set(ov)
+				}
+				return ptr.Interface(), true, nil
+			}
+		}
+	}
+	return nil, false, nil
+}
@@ -0,0 +1,100 @@
+package portal
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type userID int64
+
+type money struct {
+	cents int64
+}
+
+type status int
+
+const (
+	statusDraft status = iota + 1
+	statusPublished
+)
+
+func parseStatus(s string) (status, error) {
+	switch s {
+	case "draft":
+		return statusDraft, nil
+	case "published":
+		return statusPublished, nil
+	default:
+		return 0, errors.Errorf("unknown status '%s'", s)
+	}
+}
+
+func init() {
+	RegisterConverter(userID(0), "", func(v interface{}) (interface{}, error) {
+		return "u" + strconv.FormatInt(int64(v.(userID)), 10), nil
+	})
+	_ = RegisterConverterFunc(func(m money) string {
+		return fmt.Sprintf("%d.%02d", m.cents/100, m.cents%100)
+	})
+	_ = RegisterConverterFunc(parseStatus)
+}
+
+func TestRegisterConverter(t *testing.T) {
+	out, err := convert("", userID(42))
+	assert.Nil(t, err)
+	assert.Equal(t, "u42", out)
+
+	// pointers of from
+	id := userID(42)
+	out, err = convert("", &id)
+	assert.Nil(t, err)
+	assert.Equal(t, "u42", out)
+
+	// pointers of to
+	var target *string
+	out, err = convert(target, money{cents: 1999})
+	assert.Nil(t, err)
+	assert.Equal(t, "19.99", *(out.(*string)))
+
+	out, err = convert(status(0), "published")
+	assert.Nil(t, err)
+	assert.Equal(t, statusPublished, out)
+
+	_, err = convert(status(0), "unknown")
+	assert.NotNil(t, err)
+
+	// builtin conversions are not affected
+	out, err = convert("", 42)
+	assert.Nil(t, err)
+	assert.Equal(t, "42", out)
+}
+
+func TestRegisterConverterFunc_Invalid(t *testing.T) {
+	assert.NotNil(t, RegisterConverterFunc("not a func"))
+	assert.NotNil(t, RegisterConverterFunc(func(a, b int) string { return "" }))
+	assert.NotNil(t, RegisterConverterFunc(func(a int) (string, int) { return "", 0 }))
+}
+
+type accountModel struct {
+	ID      userID
+	Balance money
+	Status  string
+}
+
+type AccountSchema struct {
+	ID      string  `portal:"attr:ID"`
+	Balance *string `portal:"attr:Balance"`
+	Status  status  `portal:"attr:Status"`
+}
+
+func TestDump_RegisteredConverters(t *testing.T) {
+	var dst AccountSchema
+	assert.Nil(t, Dump(&dst, &accountModel{ID: 7, Balance: money{cents: 150}, Status: "draft"}))
+	assert.Equal(t, "u7", dst.ID)
+	assert.Equal(t, "1.50", *dst.Balance)
+	assert.Equal(t, statusDraft, dst.Status)
+}
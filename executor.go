@@ -0,0 +1,77 @@
+package portal
+
+import (
+	"github.com/pkg/errors"
+)
+
+// ErrExecutorBusy is returned by Executor.Submit when the executor cannot take
+// more tasks for now, the task is run in the submitting goroutine instead.
+var ErrExecutorBusy = errors.New("portal executor is busy")
+
+// Executor runs async jobs of dumps, jobs of a group (fields or elements of
+// a schema) are submitted one by one, then the submitter waits for the group.
+//
+// Submit must not block waiting for a free worker, since jobs submit nested
+// jobs; return ErrExecutorBusy instead, then the job runs inline. Bundled
+// executors are `*Pool` (the default), `NewGoroutineExecutor` and `SyncExecutor`.
+type Executor interface {
+	Submit(task func()) error
+}
+
+// jobRecorder is implemented by executors keeping statistics of jobs.
+type jobRecorder interface {
+	jobSubmitted()
+	jobInline()
+	jobShed()
+	jobDone(err error)
+}
+
+// SyncExecutor runs jobs in the submitting goroutine, in order of submission,
+// it makes dumps deterministic, e.g. in tests.
+var SyncExecutor Executor = syncExecutor{}
+
+type syncExecutor struct{}
+
+func (syncExecutor) Submit(task func()) error {
+	task()
+	return nil
+}
+
+// goroutineExecutor runs each job in a new goroutine, at most n at once.
+type goroutineExecutor struct {
+	sem chan struct{}
+}
+
+// NewGoroutineExecutor creates an executor running each job in a new goroutine,
+// at most n goroutines run at once, n <= 0 means no limit.
+// Example:
+// ```
+// chell, _ := portal.New(portal.WithExecutor(portal.NewGoroutineExecutor(100)))
+// ```
+func NewGoroutineExecutor(n int) Executor {
+	e := &goroutineExecutor{}
+	if n > 0 {
+		e.sem = make(chan struct{}, n)
+	}
+	return e
+}
+
+func (e *goroutineExecutor) Submit(task func()) error {
+	if e.sem != nil {
+		select {
+		case e.sem <- struct{}{}:
+		default:
+			return errors.WithStack(ErrExecutorBusy)
+		}
+	}
+
+	go func() {
+		if e.sem != nil {
+			defer func() { <-e.sem }()
+		}
+		task()
+	}()
+	return nil
+}
+
+var _ Executor = (*Pool)(nil)
@@ -0,0 +1,78 @@
+package portal
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type orderRecorder struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (r *orderRecorder) record(name string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.names = append(r.names, name)
+	return name
+}
+
+type orderedModel struct {
+	recorder *orderRecorder
+}
+
+type OrderedSchema struct {
+	A string `portal:"meth:GetA;async"`
+	B string `portal:"meth:GetB;async"`
+	C string `portal:"meth:GetC;async"`
+}
+
+func (s *OrderedSchema) GetA(m *orderedModel) string { return m.recorder.record("a") }
+func (s *OrderedSchema) GetB(m *orderedModel) string { return m.recorder.record("b") }
+func (s *OrderedSchema) GetC(m *orderedModel) string { return m.recorder.record("c") }
+
+func TestSyncExecutor(t *testing.T) {
+	recorder := &orderRecorder{}
+	models := []*orderedModel{{recorder}, {recorder}}
+
+	var dst []*OrderedSchema
+	assert.Nil(t, Dump(&dst, models, WithExecutor(SyncExecutor), DisableCache()))
+	assert.Equal(t, []*OrderedSchema{{A: "a", B: "b", C: "c"}, {A: "a", B: "b", C: "c"}}, dst)
+	assert.Equal(t, []string{"a", "b", "c", "a", "b", "c"}, recorder.names)
+}
+
+func TestGoroutineExecutor(t *testing.T) {
+	e := NewGoroutineExecutor(1)
+	started, done := make(chan struct{}), make(chan struct{})
+	assert.Nil(t, e.Submit(func() {
+		close(started)
+		<-done
+	}))
+	<-started
+	assert.Equal(t, ErrExecutorBusy, errors.Cause(e.Submit(func() {})))
+	close(done)
+
+	for _, n := range []int{0, 1, 4} {
+		var dst []*TreeSchema
+		roots := []*TreeModel{{Depth: 3}, {Depth: 3, Index: 1}}
+		assert.Nil(t, Dump(&dst, roots, WithExecutor(NewGoroutineExecutor(n))))
+		// 2 * (1 + 3 + 9 + 27)
+		assert.Equal(t, 80, countTree(dst))
+	}
+}
+
+type failingExecutor struct{}
+
+func (failingExecutor) Submit(task func()) error {
+	return errors.New("executor is down")
+}
+
+func TestWithExecutor_SubmitFailed(t *testing.T) {
+	var dst AsyncSchema
+	err := Dump(&dst, &Student{ID: 1}, WithExecutor(failingExecutor{}))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "executor is down")
+}
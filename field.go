@@ -5,6 +5,7 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -126,6 +127,11 @@ func (f *schemaField) isRequired() bool {
 	return f.tagHasOption("REQUIRED")
 }
 
+// isOptional reports whether the field can be shed under pressure, see option `ShedOptionalFields`.
+func (f *schemaField) isOptional() bool {
+	return f.tagHasOption("OPTIONAL")
+}
+
 func (f *schemaField) isNested() bool {
 	return f.tagHasOption("NESTED")
 }
@@ -184,7 +190,77 @@ func (f *schemaField) hasConstValue() bool {
 }
 
 func (f *schemaField) isCacheDisabled() bool {
-	return isCacheDisabled || f.schema.cacheDisabled || f.tagHasOption("DISABLECACHE")
+	return f.schema.cacheDisabled || f.tagHasOption("DISABLECACHE")
+}
+
+// cacheTTL parses the ttl from tag option `cachettl`, e.g. `cachettl:30s`.
+func (f *schemaField) cacheTTL() time.Duration {
+	ttl, _ := f.durationOption("CACHETTL")
+	return ttl
+}
+
+// durationOption parses the duration of a tag option, ok is true
+// if the option is present, even without a duration, e.g. `cachenil`.
+func (f *schemaField) durationOption(name string) (d time.Duration, ok bool) {
+	val, ok := f.settings[name]
+	if !ok || val == "" {
+		return 0, ok
+	}
+
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		logger.Warnf("[portal.field] invalid duration '%s' of option '%s' of field '%s': %s", val, strings.ToLower(name), f, err)
+		return 0, true
+	}
+	return d, true
+}
+
+// cacheOption returns the cache settings of the field, nil means
+// the cache is disabled.
+func (f *schemaField) cacheOption(noCache bool) *cacheOption {
+	if noCache || f.isCacheDisabled() {
+		return nil
+	}
+	opt := &cacheOption{ttl: f.cacheTTL(), idAttrs: f.cacheIDAttrs(), varyNames: f.cacheVaryNames(), tags: f.cacheTags()}
+	opt.nilTTL, opt.cacheNil = f.durationOption("CACHENIL")
+	opt.errTTL, opt.cacheErr = f.durationOption("CACHEERR")
+	return opt
+}
+
+// cacheVaryNames parses tag option `cachevary`, e.g. `cachevary:user_id,locale`.
+func (f *schemaField) cacheVaryNames() (names []string) {
+	result, ok := f.settings["CACHEVARY"]
+	if !ok || result == "" {
+		return nil
+	}
+	for _, name := range strings.Split(result, ",") {
+		names = append(names, strings.TrimSpace(name))
+	}
+	return
+}
+
+// cacheTags parses tag option `cachetags`, e.g. `cachetags:user,task`.
+func (f *schemaField) cacheTags() (tags []string) {
+	result, ok := f.settings["CACHETAGS"]
+	if !ok || result == "" {
+		return nil
+	}
+	for _, tag := range strings.Split(result, ",") {
+		tags = append(tags, strings.TrimSpace(tag))
+	}
+	return
+}
+
+// cacheIDAttrs parses tag option `cacheid`, e.g. `cacheid:ID`, `cacheid:Profile.ID`.
+func (f *schemaField) cacheIDAttrs() (attrs []string) {
+	result, ok := f.settings["CACHEID"]
+	if !ok || result == "" {
+		return nil
+	}
+	for _, r := range strings.Split(result, ".") {
+		attrs = append(attrs, strings.TrimSpace(r))
+	}
+	return
 }
 
 func (f *schemaField) defaultValue() interface{} {
@@ -224,14 +300,36 @@ func (f *schemaField) tagHasOption(opt string) bool {
 	return false
 }
 
-func (f *schemaField) nestedOnlyNames(customFilters []*filterNode) (names []string) {
+// nestedOnlyNames returns the names of fields to keep in the nested schema,
+// none is true if no fields are selected, instead of falling back to all fields.
+// fieldFilters is the filter level holding the field itself, customFilters the
+// level holding its nested fields.
+func (f *schemaField) nestedOnlyNames(fieldFilters, customFilters []*filterNode, mode FilterCombineMode) (names []string, none bool) {
+	if f.filteredToNone(fieldFilters) {
+		tagNames := f.nestedOnlyNamesParsedFromTag()
+		if mode == FilterMergeTag && len(tagNames) > 0 {
+			return tagNames, false
+		}
+		return nil, true
+	}
+
 	filterNames := extractFilterNodeNames(
 		customFilters, &extractOption{queryByParentName: f.Name(), queryByParentNameAlias: f.alias})
-	if len(filterNames) > 0 {
-		return filterNames
-	} else {
-		return f.nestedOnlyNamesParsedFromTag()
+	names = f.combineNestedNames(mode, filterNames, f.nestedOnlyNamesParsedFromTag())
+	// nothing in common with the tag settings.
+	none = len(filterNames) > 0 && len(names) == 0
+	return names, none
+}
+
+// filteredToNone reports whether the field is selected with an empty list,
+// e.g. `A[]`.
+func (f *schemaField) filteredToNone(fieldFilters []*filterNode) bool {
+	for _, n := range fieldFilters {
+		if n.None && (n.Name == f.Name() || (f.alias != "" && n.Name == f.alias)) {
+			return true
+		}
 	}
+	return false
 }
 
 func (f *schemaField) nestedOnlyNamesParsedFromTag() (names []string) {
@@ -243,16 +341,62 @@ func (f *schemaField) nestedOnlyNamesParsedFromTag() (names []string) {
 	return
 }
 
-func (f *schemaField) nestedExcludeNames(customFilters []*filterNode) []string {
-	fieldNames := extractFilterNodeNames(
+func (f *schemaField) nestedExcludeNames(customFilters []*filterNode, mode FilterCombineMode) []string {
+	filterNames := extractFilterNodeNames(
 		customFilters,
 		&extractOption{ignoreNodeWithChildren: true, queryByParentName: f.Name(), queryByParentNameAlias: f.alias},
 	)
-	if len(fieldNames) > 0 {
-		return fieldNames
-	} else {
-		return f.nestedExcludeNamesParsedFromTag()
+	return f.combineNestedNames(mode, filterNames, f.nestedExcludeNamesParsedFromTag())
+}
+
+// combineNestedNames combines field names from the runtime filter with
+// the ones parsed from tag. Names are compared by field name, so aliases
+// are resolved against the nested schema first.
+func (f *schemaField) combineNestedNames(mode FilterCombineMode, filterNames, tagNames []string) []string {
+	if len(filterNames) == 0 {
+		return tagNames
+	}
+
+	if len(tagNames) == 0 || mode == FilterOverrideTag {
+		return filterNames
+	}
+
+	nestedSchema := newSchema(reflect.New(indirectStructTypeP(reflect.TypeOf(f.Value()))).Interface())
+	canonicalName := func(name string) string {
+		if field := nestedSchema.fieldByNameOrAlias(name); field != nil {
+			return field.Name()
+		}
+		return name
 	}
+
+	tagNameSet := make(map[string]bool, len(tagNames))
+	for _, name := range tagNames {
+		tagNameSet[canonicalName(name)] = true
+	}
+
+	names := make([]string, 0, len(filterNames)+len(tagNames))
+	switch mode {
+	case FilterMergeTag:
+		seen := make(map[string]bool, len(filterNames))
+		for _, name := range filterNames {
+			seen[canonicalName(name)] = true
+			names = append(names, name)
+		}
+		for _, name := range tagNames {
+			if !seen[canonicalName(name)] {
+				names = append(names, name)
+			}
+		}
+	case FilterIntersectTag:
+		for _, name := range filterNames {
+			if tagNameSet[canonicalName(name)] {
+				names = append(names, name)
+			}
+		}
+	default:
+		return filterNames
+	}
+	return names
 }
 
 func (f *schemaField) nestedExcludeNamesParsedFromTag() (names []string) {
@@ -264,6 +408,18 @@ func (f *schemaField) nestedExcludeNamesParsedFromTag() (names []string) {
 	return
 }
 
+// dependencies parses tag option `after`, e.g. `after:Name,Profile`.
+func (f *schemaField) dependencies() (names []string) {
+	result, ok := f.settings["AFTER"]
+	if !ok || result == "" {
+		return nil
+	}
+	for _, name := range strings.Split(result, ",") {
+		names = append(names, strings.TrimSpace(name))
+	}
+	return
+}
+
 func (f *schemaField) async() bool {
 	return f.tagHasOption("ASYNC")
 }
@@ -207,7 +207,9 @@ func TestField_NestedOnlyNames(t *testing.T) {
 
 	schema := newSchema(&FooSchema{})
 	f := newField(schema, schema.innerStruct().Field("Bar"))
-	assert.Equal(t, []string{"Name"}, f.nestedOnlyNames(nil))
+	names, none := f.nestedOnlyNames(nil, nil, FilterOverrideTag)
+	assert.Equal(t, []string{"Name"}, names)
+	assert.False(t, none)
 }
 
 func TestField_NestedExcludeNames(t *testing.T) {
@@ -222,7 +224,7 @@ func TestField_NestedExcludeNames(t *testing.T) {
 
 	schema := newSchema(&FooSchema{})
 	f := newField(schema, schema.innerStruct().Field("Bar"))
-	assert.Equal(t, []string{"Name"}, f.nestedExcludeNames(nil))
+	assert.Equal(t, []string{"Name"}, f.nestedExcludeNames(nil, FilterOverrideTag))
 }
 
 type Person struct {
@@ -259,6 +261,33 @@ func (v ErrorValue) Value() (interface{}, error) {
 	return 0, errors.New("error value")
 }
 
+func TestField_CacheTTL(t *testing.T) {
+	type FooSchema struct {
+		Name    string
+		Bar     string `portal:"attr:Bar;cachettl:30s"`
+		Invalid string `portal:"attr:Bar;cachettl:forever"`
+		NoCache string `portal:"attr:Bar;cachettl:30s;disablecache"`
+	}
+
+	SetCache(DefaultCache)
+	defer SetCache(nil)
+
+	schema := newSchema(&FooSchema{})
+	f := newField(schema, schema.innerStruct().Field("Name"))
+	assert.Equal(t, time.Duration(0), f.cacheTTL())
+
+	f = newField(schema, schema.innerStruct().Field("Bar"))
+	assert.Equal(t, 30*time.Second, f.cacheTTL())
+	assert.Equal(t, &cacheOption{ttl: 30 * time.Second}, f.cacheOption(false))
+	assert.Nil(t, f.cacheOption(true))
+
+	f = newField(schema, schema.innerStruct().Field("Invalid"))
+	assert.Equal(t, time.Duration(0), f.cacheTTL())
+
+	f = newField(schema, schema.innerStruct().Field("NoCache"))
+	assert.Nil(t, f.cacheOption(false))
+}
+
 func TestField_SetValue(t *testing.T) {
 	type BarSchema struct {
 		ID   string
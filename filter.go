@@ -2,6 +2,7 @@ package portal
 
 import (
 	"encoding/json"
+	"fmt"
 	"strings"
 	"sync"
 
@@ -9,18 +10,51 @@ import (
 )
 
 var (
-	errUnmatchedBrackets  = errors.New("unmatched brackets")
-	errPrefixIsNotBracket = errors.New("filter string must starts with '['")
+	// ErrUnmatchedBrackets means a '[' is not closed or a ']' is not opened.
+	ErrUnmatchedBrackets = errors.New("unmatched brackets")
+	// ErrPrefixIsNotBracket means a bracketed filter string doesn't start with '['.
+	ErrPrefixIsNotBracket = errors.New("filter string must starts with '['")
+	// ErrEmptyFieldName means a field name is missing, e.g. `A[,]` or `A,,B`.
+	ErrEmptyFieldName = errors.New("empty field name")
+	// ErrUnexpectedToken means a token is not allowed at its position, e.g. `A]B[`.
+	ErrUnexpectedToken = errors.New("unexpected token")
+	// ErrUnterminatedQuote means a quoted field name is not closed.
+	ErrUnterminatedQuote = errors.New("unterminated quote")
 )
 
 var (
 	cachedFilterResultMap sync.Map
 )
 
+// FilterSyntaxError describes a syntax error in a filter string.
+// Use `errors.Is` to check the underlying error, e.g. `ErrUnmatchedBrackets`.
+type FilterSyntaxError struct {
+	// Offset is the byte offset of the offending token.
+	Offset int
+	// Token is the offending token, it's empty at the end of the input.
+	Token string
+	Err   error
+}
+
+func (e *FilterSyntaxError) Error() string {
+	if e.Token == "" {
+		return fmt.Sprintf("%s at end of filter (offset %d)", e.Err, e.Offset)
+	}
+	return fmt.Sprintf("%s '%s' at offset %d", e.Err, e.Token, e.Offset)
+}
+
+// Unwrap returns the underlying error.
+func (e *FilterSyntaxError) Unwrap() error {
+	return e.Err
+}
+
 type filterNode struct {
 	Name     string        `json:"name"`
 	Parent   *filterNode   `json:"-"`
 	Children []*filterNode `json:"children"`
+	// None is set for an explicit empty selection (e.g. `A[]`),
+	// which selects no fields of the nested schema.
+	None bool `json:"none,omitempty"`
 }
 
 func (node *filterNode) String() string {
@@ -54,7 +88,7 @@ func extractFilterNodeNames(nodes []*filterNode, opt *extractOption) []string {
 			continue
 		}
 
-		if opt.ignoreNodeWithChildren && len(n.Children) > 0 {
+		if opt.ignoreNodeWithChildren && (len(n.Children) > 0 || n.None) {
 			continue
 		}
 
@@ -63,8 +97,17 @@ func extractFilterNodeNames(nodes []*filterNode, opt *extractOption) []string {
 	return names
 }
 
+// parseFilters parses filter strings (e.g. `A`, `B[C,D]`) to a filter tree
+// (with extra levels). Empty strings are ignored, error offsets are relative to
+// the filter strings joined by ','.
 func parseFilters(filters []string) (map[int][]*filterNode, error) {
-	return parseFilterString("[" + strings.Join(filters, ",") + "]")
+	nonEmpty := make([]string, 0, len(filters))
+	for _, f := range filters {
+		if strings.TrimSpace(f) != "" {
+			nonEmpty = append(nonEmpty, f)
+		}
+	}
+	return parseFilterTree(strings.Join(nonEmpty, ","), false)
 }
 
 // parseFilterString parses filter string to a filter tree (with extra levels).
@@ -72,113 +115,528 @@ func parseFilters(filters []string) (map[int][]*filterNode, error) {
 // 1. [speaker[id,name]]
 // 2. [speaker[id,name,vip_info[type,is_active]]]
 func parseFilterString(s string) (map[int][]*filterNode, error) {
-	s = strings.TrimSpace(s)
-	if s == "" {
+	if strings.TrimSpace(s) == "" {
 		return nil, nil
 	}
+	return parseFilterTree(s, true)
+}
 
-	if !strings.HasPrefix(s, "[") {
-		return nil, errPrefixIsNotBracket
+func parseFilterTree(s string, bracketed bool) (map[int][]*filterNode, error) {
+	cacheKey := s
+	if bracketed {
+		cacheKey = "[]" + s
 	}
 
-	cachedResult, ok := cachedFilterResultMap.Load(s)
+	cachedResult, ok := cachedFilterResultMap.Load(cacheKey)
 	if ok {
 		rv, _ := cachedResult.(map[int][]*filterNode)
 		return rv, nil
 	}
 
-	// don't care about non-ascii chars.
-	filterInBytes := []byte(s)
-	err := checkBracketPairs(filterInBytes)
+	roots, err := newFilterParser(s, bracketed).parse()
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, err
 	}
 
-	result := doParse(filterInBytes)
-	cachedFilterResultMap.Store(s, result)
+	result := (&Filter{roots: roots}).levels()
+	cachedFilterResultMap.Store(cacheKey, result)
 	return result, nil
 }
 
-func checkBracketPairs(s []byte) error {
-	stack := newStack()
-	for _, c := range s {
-		switch c {
-		case '[':
-			stack.push(c)
-		case ']':
-			x, err := stack.pop()
+type filterTokenKind int
+
+const (
+	filterTokenEOF filterTokenKind = iota
+	filterTokenName
+	filterTokenComma
+	filterTokenOpen
+	filterTokenClose
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	// raw is the token text in the input, value is the unquoted name.
+	raw    string
+	value  string
+	offset int
+}
+
+type filterLexer struct {
+	src string
+	pos int
+}
+
+// isFilterNameChar reports whether c can be used in an unquoted field name.
+// Names containing other characters (e.g. `.`) must be quoted.
+func isFilterNameChar(c byte) bool {
+	return c == '_' || c == '-' || c >= 0x80 ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func (l *filterLexer) next() (filterToken, error) {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+			break
+		}
+		l.pos++
+	}
+
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return filterToken{kind: filterTokenEOF, offset: start}, nil
+	}
+
+	c := l.src[l.pos]
+	switch {
+	case c == ',':
+		l.pos++
+		return filterToken{kind: filterTokenComma, raw: ",", offset: start}, nil
+	case c == '[':
+		l.pos++
+		return filterToken{kind: filterTokenOpen, raw: "[", offset: start}, nil
+	case c == ']':
+		l.pos++
+		return filterToken{kind: filterTokenClose, raw: "]", offset: start}, nil
+	case c == '"' || c == '\'':
+		return l.readQuoted(c)
+	case isFilterNameChar(c):
+		for l.pos < len(l.src) && isFilterNameChar(l.src[l.pos]) {
+			l.pos++
+		}
+		name := l.src[start:l.pos]
+		return filterToken{kind: filterTokenName, raw: name, value: name, offset: start}, nil
+	default:
+		return filterToken{}, &FilterSyntaxError{Offset: start, Token: string(c), Err: ErrUnexpectedToken}
+	}
+}
+
+func (l *filterLexer) readQuoted(quote byte) (filterToken, error) {
+	start := l.pos
+	var sb strings.Builder
+	for l.pos++; l.pos < len(l.src); l.pos++ {
+		c := l.src[l.pos]
+		switch {
+		case c == '\\' && l.pos+1 < len(l.src):
+			l.pos++
+			sb.WriteByte(l.src[l.pos])
+		case c == quote:
+			l.pos++
+			raw := l.src[start:l.pos]
+			if sb.Len() == 0 {
+				return filterToken{}, &FilterSyntaxError{Offset: start, Token: raw, Err: ErrEmptyFieldName}
+			}
+			return filterToken{kind: filterTokenName, raw: raw, value: sb.String(), offset: start}, nil
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return filterToken{}, &FilterSyntaxError{Offset: start, Token: l.src[start:], Err: ErrUnterminatedQuote}
+}
+
+type filterParserState int
+
+const (
+	// at the beginning of a list, an empty list is allowed.
+	stateListStart filterParserState = iota
+	stateAfterComma
+	stateAfterName
+	stateAfterClose
+	// the outer brackets of a bracketed filter string is closed.
+	stateDone
+)
+
+type filterFrame struct {
+	parent *filterNode
+	open   filterToken
+}
+
+type filterParser struct {
+	lexer     *filterLexer
+	bracketed bool
+}
+
+func newFilterParser(s string, bracketed bool) *filterParser {
+	return &filterParser{lexer: &filterLexer{src: s}, bracketed: bracketed}
+}
+
+// parse parses the filter string with the grammar:
+// ```
+// filter := list | '[' list ']'
+// list   := <empty> | item (',' item)*
+// item   := name ('[' list ']')?
+// name   := [_a-zA-Z0-9-]+ | quoted
+// ```
+func (p *filterParser) parse() ([]*filterNode, error) {
+	var (
+		roots    []*filterNode
+		lastNode *filterNode
+		state    = stateListStart
+		frames   = newStack()
+	)
+
+	if p.bracketed {
+		tok, err := p.lexer.next()
+		if err != nil {
+			return nil, err
+		}
+		if tok.kind != filterTokenOpen {
+			return nil, &FilterSyntaxError{Offset: tok.offset, Token: tok.raw, Err: ErrPrefixIsNotBracket}
+		}
+		frames.push(&filterFrame{open: tok})
+	}
+
+	unexpected := func(tok filterToken, err error) error {
+		return &FilterSyntaxError{Offset: tok.offset, Token: tok.raw, Err: err}
+	}
+
+	for {
+		tok, err := p.lexer.next()
+		if err != nil {
+			return nil, err
+		}
+
+		if state == stateDone && tok.kind != filterTokenEOF {
+			return nil, unexpected(tok, ErrUnexpectedToken)
+		}
+
+		switch tok.kind {
+		case filterTokenName:
+			if state != stateListStart && state != stateAfterComma {
+				return nil, unexpected(tok, ErrUnexpectedToken)
+			}
+
+			var parent *filterNode
+			if top, err := frames.top(); err == nil {
+				parent = top.(*filterFrame).parent
+			}
+			node := &filterNode{Name: tok.value, Parent: parent}
+			if parent != nil {
+				parent.Children = append(parent.Children, node)
+			} else {
+				roots = append(roots, node)
+			}
+			lastNode = node
+			state = stateAfterName
+		case filterTokenComma:
+			switch state {
+			case stateAfterName, stateAfterClose:
+				state = stateAfterComma
+			default:
+				return nil, unexpected(tok, ErrEmptyFieldName)
+			}
+		case filterTokenOpen:
+			if state != stateAfterName {
+				return nil, unexpected(tok, ErrUnexpectedToken)
+			}
+			frames.push(&filterFrame{parent: lastNode, open: tok})
+			state = stateListStart
+		case filterTokenClose:
+			if state == stateAfterComma {
+				return nil, unexpected(tok, ErrEmptyFieldName)
+			}
+			x, err := frames.pop()
 			if err != nil {
-				return errUnmatchedBrackets
+				return nil, unexpected(tok, ErrUnmatchedBrackets)
 			}
-			if xc, ok := x.(byte); ok {
-				if xc == '[' {
-					continue
-				}
+			lastNode = x.(*filterFrame).parent
+			if lastNode != nil && state == stateListStart {
+				// `A[]` selects no fields of A.
+				lastNode.None = true
 			}
-			return errUnmatchedBrackets
-		default:
-			continue
+			state = stateAfterClose
+			if lastNode == nil {
+				// the outer brackets
+				state = stateDone
+			}
+		case filterTokenEOF:
+			if state == stateAfterComma {
+				return nil, unexpected(tok, ErrEmptyFieldName)
+			}
+			if x, err := frames.top(); err == nil {
+				return nil, unexpected(x.(*filterFrame).open, ErrUnmatchedBrackets)
+			}
+			return roots, nil
 		}
 	}
+}
+
+// Filter is a parsed field filter tree. It can be built from filter strings
+// like `A,B[C,D[E]]` and combined with other filters before being passed to
+// option `OnlyFilter` or `ExcludeFilter`.
+// A field without children selects the whole nested schema, while a field
+// with an empty list (e.g. `A[]`) selects none of its fields.
+type Filter struct {
+	roots []*filterNode
+	// none selects no fields at all, unlike an empty filter which
+	// selects all fields.
+	none bool
+}
 
-	if stack.size() > 0 {
-		return errUnmatchedBrackets
+// ParseFilter parses filter strings to a filter tree.
+// Examples:
+// ```
+// f, err := ParseFilter("A", "B[C,D]")
+// f, err := ParseFilter("A,B[C,D]")
+// ```
+func ParseFilter(fields ...string) (*Filter, error) {
+	levels, err := parseFilters(fields)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &Filter{roots: levels[0]}, nil
+}
+
+// String returns the canonical filter string, e.g. `A,B[C,D]`.
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
 	}
 
+	var sb strings.Builder
+	writeFilterNodes(&sb, f.roots)
+	return sb.String()
+}
+
+func writeFilterNodes(sb *strings.Builder, nodes []*filterNode) {
+	for i, n := range nodes {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		writeFilterName(sb, n.Name)
+		if n.None {
+			sb.WriteString("[]")
+		} else if len(n.Children) > 0 {
+			sb.WriteByte('[')
+			writeFilterNodes(sb, n.Children)
+			sb.WriteByte(']')
+		}
+	}
+}
+
+// writeFilterName writes the name, quoted if it contains
+// characters not allowed in an unquoted name.
+func writeFilterName(sb *strings.Builder, name string) {
+	for i := 0; i < len(name); i++ {
+		if !isFilterNameChar(name[i]) {
+			sb.WriteByte('"')
+			sb.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name))
+			sb.WriteByte('"')
+			return
+		}
+	}
+	sb.WriteString(name)
+}
+
+// Fields returns names of the top level fields.
+func (f *Filter) Fields() []string {
+	if f == nil {
+		return nil
+	}
+	return extractFilterNodeNames(f.roots, nil)
+}
+
+// Child returns the sub filter of the named field.
+// It returns nil if the field is not found or the whole field is selected,
+// and an empty filter if none of its fields are selected.
+func (f *Filter) Child(name string) *Filter {
+	if f == nil {
+		return nil
+	}
+
+	n := findFilterNode(f.roots, name)
+	if n == nil || (len(n.Children) == 0 && !n.None) {
+		return nil
+	}
+	return &Filter{roots: n.Children}
+}
+
+// Contains reports whether the field path (e.g. `A.B.C`) is selected by the filter.
+// Names containing '.' cannot be addressed by a path.
+func (f *Filter) Contains(path string) bool {
+	if f == nil || path == "" {
+		return false
+	}
+
+	nodes := f.roots
+	for _, name := range strings.Split(path, ".") {
+		n := findFilterNode(nodes, strings.TrimSpace(name))
+		if n == nil {
+			return false
+		}
+		if len(n.Children) == 0 && !n.None {
+			return true
+		}
+		nodes = n.Children
+	}
+	return true
+}
+
+// Merge returns a new filter selecting fields in either f or other.
+func (f *Filter) Merge(other *Filter) *Filter {
+	switch {
+	case f.selectsNone():
+		return &Filter{roots: cloneFilterNodes(other.nodes(), nil), none: other.selectsNone()}
+	case other.selectsNone():
+		return &Filter{roots: cloneFilterNodes(f.nodes(), nil)}
+	}
+	return &Filter{roots: mergeFilterNodes(f.nodes(), other.nodes(), nil)}
+}
+
+// Intersect returns a new filter selecting fields in both f and other.
+func (f *Filter) Intersect(other *Filter) *Filter {
+	if f.selectsNone() || other.selectsNone() {
+		return &Filter{none: true}
+	}
+	roots := intersectFilterNodes(f.nodes(), other.nodes(), nil)
+	// nothing in common is not the same as no filter.
+	return &Filter{roots: roots, none: len(roots) == 0 && len(f.nodes()) > 0 && len(other.nodes()) > 0}
+}
+
+// Subtract returns a new filter selecting fields in f but not in other.
+// Note that a field selected as a whole in f is kept as is if other only
+// removes some of its children, since the remaining children are unknown
+// without the schema definition.
+func (f *Filter) Subtract(other *Filter) *Filter {
+	if f.selectsNone() {
+		return &Filter{none: true}
+	}
+	roots := subtractFilterNodes(f.nodes(), other.nodes(), nil)
+	return &Filter{roots: roots, none: len(roots) == 0 && len(f.nodes()) > 0}
+}
+
+// selectsNone reports whether the filter selects no fields.
+func (f *Filter) selectsNone() bool {
+	return f != nil && f.none
+}
+
+func (f *Filter) nodes() []*filterNode {
+	if f == nil {
+		return nil
+	}
+	return f.roots
+}
+
+// levels converts the filter tree to the level based form used by Chell.
+func (f *Filter) levels() map[int][]*filterNode {
+	if f == nil || len(f.roots) == 0 {
+		return nil
+	}
+
+	result := make(map[int][]*filterNode)
+	nodes := f.roots
+	for level := 0; len(nodes) > 0; level++ {
+		result[level] = nodes
+		var next []*filterNode
+		for _, n := range nodes {
+			next = append(next, n.Children...)
+		}
+		nodes = next
+	}
+	return result
+}
+
+func findFilterNode(nodes []*filterNode, name string) *filterNode {
+	for _, n := range nodes {
+		if n.Name == name {
+			return n
+		}
+	}
 	return nil
 }
 
-// doParse parses filter string to a filter tree.
-// Note: stupid & ugly~
-func doParse(s []byte) map[int][]*filterNode {
-	var (
-		wordBuf            []byte
-		levelNodesMap      = make(map[int][]*filterNode)
-		levelParentNodeMap = map[int]*filterNode{-1: nil}
-		level              = -1
-	)
+func cloneFilterNodes(nodes []*filterNode, parent *filterNode) []*filterNode {
+	if len(nodes) == 0 {
+		return nil
+	}
 
-	appendNodes := func() *filterNode {
-		if len(wordBuf) == 0 {
-			return nil
+	cloned := make([]*filterNode, 0, len(nodes))
+	for _, n := range nodes {
+		node := &filterNode{Name: n.Name, Parent: parent, None: n.None}
+		node.Children = cloneFilterNodes(n.Children, node)
+		cloned = append(cloned, node)
+	}
+	return cloned
+}
+
+func mergeFilterNodes(a, b []*filterNode, parent *filterNode) []*filterNode {
+	result := make([]*filterNode, 0, len(a)+len(b))
+	for _, x := range a {
+		y := findFilterNode(b, x.Name)
+		switch {
+		case y == nil || y.None:
+			result = append(result, cloneFilterNodes([]*filterNode{x}, parent)...)
+			continue
+		case x.None:
+			result = append(result, cloneFilterNodes([]*filterNode{y}, parent)...)
+			continue
 		}
 
-		nthLevelNodes, ok := levelNodesMap[level]
-		if !ok || nthLevelNodes == nil {
-			nthLevelNodes = make([]*filterNode, 0)
+		node := &filterNode{Name: x.Name, Parent: parent}
+		if len(x.Children) > 0 && len(y.Children) > 0 {
+			node.Children = mergeFilterNodes(x.Children, y.Children, node)
 		}
+		// otherwise the whole field is selected by one side
+		result = append(result, node)
+	}
 
-		node := &filterNode{Name: string(wordBuf), Parent: levelParentNodeMap[level]}
-		if node.Parent != nil {
-			node.Parent.Children = append(node.Parent.Children, node)
+	for _, y := range b {
+		if findFilterNode(a, y.Name) == nil {
+			result = append(result, cloneFilterNodes([]*filterNode{y}, parent)...)
 		}
-		nthLevelNodes = append(nthLevelNodes, node)
-		levelNodesMap[level] = nthLevelNodes
-		wordBuf = make([]byte, 0)
-		return node
 	}
+	return result
+}
 
-	for _, char := range s {
-		switch char {
-		case '\t', '\n', ' ':
+func intersectFilterNodes(a, b []*filterNode, parent *filterNode) []*filterNode {
+	result := make([]*filterNode, 0, len(a))
+	for _, x := range a {
+		y := findFilterNode(b, x.Name)
+		if y == nil {
 			continue
-		case ',':
-			_ = appendNodes()
-		case '[':
-			node := appendNodes()
-			level++
-			if node != nil {
-				levelParentNodeMap[level] = node
-			}
-		case ']':
-			appendNodes()
-			level--
+		}
+
+		node := &filterNode{Name: x.Name, Parent: parent}
+		switch {
+		case x.None || y.None:
+			node.None = true
+		case len(x.Children) == 0:
+			node.Children = cloneFilterNodes(y.Children, node)
+		case len(y.Children) == 0:
+			node.Children = cloneFilterNodes(x.Children, node)
 		default:
-			wordBuf = append(wordBuf, char)
+			node.Children = intersectFilterNodes(x.Children, y.Children, node)
+			if len(node.Children) == 0 {
+				// no common children, drop the whole field.
+				continue
+			}
 		}
+		result = append(result, node)
 	}
+	return result
+}
 
-	appendNodes()
-
-	return levelNodesMap
+func subtractFilterNodes(a, b []*filterNode, parent *filterNode) []*filterNode {
+	result := make([]*filterNode, 0, len(a))
+	for _, x := range a {
+		node := &filterNode{Name: x.Name, Parent: parent, None: x.None}
+		y := findFilterNode(b, x.Name)
+		switch {
+		case y == nil || y.None || x.None:
+			// nothing to remove from the nested schema.
+			node.Children = cloneFilterNodes(x.Children, node)
+		case len(y.Children) == 0:
+			// the whole field is removed.
+			continue
+		case len(x.Children) == 0:
+			// cannot narrow a whole field without the schema definition.
+		default:
+			node.Children = subtractFilterNodes(x.Children, y.Children, node)
+			if len(node.Children) == 0 {
+				continue
+			}
+		}
+		result = append(result, node)
+	}
+	return result
 }
@@ -0,0 +1,49 @@
+//go:build go1.18
+// +build go1.18
+
+package portal
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func FuzzParseFilter(f *testing.F) {
+	for _, seed := range []string{
+		"A",
+		"A,B[C,D[E]],F",
+		"speaker[name,age[user[id]]]",
+		`"user.name",'user-id'["a\"b"]`,
+		"A[,]",
+		"A]B[",
+		"A[B][C]",
+		" A [ B , C ] ",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		filter, err := ParseFilter(s)
+		if err != nil {
+			var syntaxErr *FilterSyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("unexpected error type for %q: %s", s, err)
+			}
+			if syntaxErr.Offset < 0 || syntaxErr.Offset > len(s) {
+				t.Fatalf("invalid error offset %d for %q", syntaxErr.Offset, s)
+			}
+			return
+		}
+
+		// the canonical string must be parsed to the same filter.
+		canonical := filter.String()
+		reparsed, err := ParseFilter(canonical)
+		if err != nil {
+			t.Fatalf("failed to parse canonical filter %q of %q: %s", canonical, s, err)
+		}
+		if reparsed.String() != canonical {
+			t.Fatalf("canonical filter changed: %q -> %q", canonical, reparsed.String())
+		}
+	})
+}
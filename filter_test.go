@@ -3,6 +3,8 @@ package portal
 import (
 	"testing"
 
+	"github.com/pkg/errors"
+
 	"github.com/stretchr/testify/assert"
 )
 
@@ -137,15 +139,198 @@ func TestParseFilterString_BoundaryConditions(t *testing.T) {
 	asserter.Nil(node)
 
 	_, err = parseFilterString("A")
-	asserter.Equal(errPrefixIsNotBracket, err)
+	asserter.Equal(ErrPrefixIsNotBracket, filterSyntaxCause(err))
+
+	node, err = parseFilterString("[]")
+	asserter.Nil(err)
+	asserter.Nil(node)
+
+	_, err = parseFilterString("[A],B")
+	asserter.Equal(ErrUnexpectedToken, filterSyntaxCause(err))
+}
+
+// filterSyntaxCause returns the cause of a *FilterSyntaxError, or err itself.
+func filterSyntaxCause(err error) error {
+	if syntaxErr, ok := errors.Cause(err).(*FilterSyntaxError); ok {
+		return syntaxErr.Err
+	}
+	return err
+}
+
+func TestParseFilters_Brackets(t *testing.T) {
+	asserter := assert.New(t)
+
+	_, err := parseFilters([]string{"speaker"})
+	asserter.Nil(err)
+	_, err = parseFilters([]string{"speaker[]"})
+	asserter.Nil(err)
+	_, err = parseFilters([]string{"speaker[name,age[user[id]]]"})
+	asserter.Nil(err)
+	_, err = parseFilters([]string{"speaker["})
+	asserter.Equal(ErrUnmatchedBrackets, filterSyntaxCause(err))
+	_, err = parseFilters([]string{"speaker]"})
+	asserter.Equal(ErrUnmatchedBrackets, filterSyntaxCause(err))
+	_, err = parseFilters([]string{"speaker[user[id]]]"})
+	asserter.Equal(ErrUnmatchedBrackets, filterSyntaxCause(err))
+}
+
+func TestParseFilters_SyntaxErrors(t *testing.T) {
+	cases := []struct {
+		filter string
+		err    error
+		offset int
+		token  string
+	}{
+		{"A[,]", ErrEmptyFieldName, 2, ","},
+		{"A,,B", ErrEmptyFieldName, 2, ","},
+		{",A", ErrEmptyFieldName, 0, ","},
+		{"A,", ErrEmptyFieldName, 2, ""},
+		{"A[B,]", ErrEmptyFieldName, 4, "]"},
+		{"A]B[", ErrUnmatchedBrackets, 1, "]"},
+		{"A[B[C]", ErrUnmatchedBrackets, 1, "["},
+		{"A B", ErrUnexpectedToken, 2, "B"},
+		{"A[B]C", ErrUnexpectedToken, 4, "C"},
+		{"A[B][C]", ErrUnexpectedToken, 4, "["},
+		{"[A]", ErrUnexpectedToken, 0, "["},
+		{"A.B", ErrUnexpectedToken, 1, "."},
+		{`A["B`, ErrUnterminatedQuote, 2, `"B`},
+		{`A[""]`, ErrEmptyFieldName, 2, `""`},
+	}
+
+	for _, c := range cases {
+		_, err := parseFilters([]string{c.filter})
+		if !assert.NotNil(t, err, c.filter) {
+			continue
+		}
+		assert.Equal(t, c.err, filterSyntaxCause(err), "%s: %s", c.filter, err)
+
+		syntaxErr, ok := errors.Cause(err).(*FilterSyntaxError)
+		if assert.True(t, ok, c.filter) {
+			assert.Equal(t, c.offset, syntaxErr.Offset, c.filter)
+			assert.Equal(t, c.token, syntaxErr.Token, c.filter)
+		}
+	}
+
+	_, err := parseFilters([]string{"A", "B]"})
+	assert.EqualError(t, err, "unmatched brackets ']' at offset 3")
+	_, err = parseFilters([]string{"A,"})
+	assert.EqualError(t, err, "empty field name at end of filter (offset 2)")
+}
+
+func TestParseFilters_QuotedNames(t *testing.T) {
+	asserter := assert.New(t)
+
+	f, err := ParseFilter(`"user.name", 'user-id'[ "a\"b" ], plain-name`)
+	asserter.Nil(err)
+	asserter.Equal([]string{"user.name", "user-id", "plain-name"}, f.Fields())
+	asserter.Equal([]string{`a"b`}, f.Child("user-id").Fields())
+	asserter.Equal(`"user.name",user-id["a\"b"],plain-name`, f.String())
+
+	// empty filter strings are ignored
+	f, err = ParseFilter("", "A", " ")
+	asserter.Nil(err)
+	asserter.Equal("A", f.String())
+}
+
+func TestParseFilter(t *testing.T) {
+	asserter := assert.New(t)
+
+	f, err := ParseFilter("A", "B[ C,D[E]]", "F")
+	asserter.Nil(err)
+	asserter.Equal("A,B[C,D[E]],F", f.String())
+	asserter.Equal([]string{"A", "B", "F"}, f.Fields())
+	asserter.Equal("C,D[E]", f.Child("B").String())
+	asserter.Nil(f.Child("A"))
+	asserter.Nil(f.Child("X"))
+
+	_, err = ParseFilter("A[")
+	asserter.NotNil(err)
+
+	var nilFilter *Filter
+	asserter.Equal("", nilFilter.String())
+	asserter.False(nilFilter.Contains("A"))
+}
+
+func TestFilter_Contains(t *testing.T) {
+	asserter := assert.New(t)
+
+	f, err := ParseFilter("A,B[C,D[E]]")
+	asserter.Nil(err)
+	asserter.True(f.Contains("A"))
+	asserter.True(f.Contains("A.X"))
+	asserter.True(f.Contains("B"))
+	asserter.True(f.Contains("B.C"))
+	asserter.True(f.Contains("B.D.E"))
+	asserter.False(f.Contains("B.D.F"))
+	asserter.False(f.Contains("B.X"))
+	asserter.False(f.Contains("X"))
+	asserter.False(f.Contains(""))
+
+	f, err = ParseFilter("A[]")
+	asserter.Nil(err)
+	asserter.Equal("A[]", f.String())
+	asserter.True(f.Contains("A"))
+	asserter.False(f.Contains("A.X"))
+	asserter.Equal("", f.Child("A").String())
+	asserter.NotNil(f.Child("A"))
 }
 
-func Test_checkBracketPair(t *testing.T) {
+func TestFilter_SetOperations(t *testing.T) {
 	asserter := assert.New(t)
-	asserter.Nil(checkBracketPairs([]byte("speaker")))
-	asserter.Nil(checkBracketPairs([]byte("speaker[]")))
-	asserter.Nil(checkBracketPairs([]byte("speaker[name,age[user[id]]]")))
-	asserter.Equal(errUnmatchedBrackets, checkBracketPairs([]byte("speaker[")))
-	asserter.Equal(errUnmatchedBrackets, checkBracketPairs([]byte("speaker]")))
-	asserter.Equal(errUnmatchedBrackets, checkBracketPairs([]byte("speaker[user[id]]]")))
+
+	mustParse := func(s string) *Filter {
+		f, err := ParseFilter(s)
+		asserter.Nil(err)
+		return f
+	}
+
+	cases := []struct {
+		a, b                       string
+		merged, intersected, diffs string
+	}{
+		{"A,B", "B,C", "A,B,C", "B", "A"},
+		{"A", "A[B]", "A", "A[B]", "A"},
+		{"A[B]", "A", "A", "A[B]", ""},
+		{"A[B,C]", "A[C,D]", "A[B,C,D]", "A[C]", "A[B]"},
+		{"A[B[X,Y]]", "A[B[Y,Z]]", "A[B[X,Y,Z]]", "A[B[Y]]", "A[B[X]]"},
+		{"A[B]", "A[C]", "A[B,C]", "", "A[B]"},
+		{"A[]", "A[B]", "A[B]", "A[]", "A[]"},
+		{"A[]", "A", "A", "A[]", "A[]"},
+		{"A[B]", "A[]", "A[B]", "A[]", "A[B]"},
+	}
+
+	for _, c := range cases {
+		a, b := mustParse(c.a), mustParse(c.b)
+		asserter.Equal(c.merged, a.Merge(b).String(), "%s merge %s", c.a, c.b)
+		asserter.Equal(c.intersected, a.Intersect(b).String(), "%s intersect %s", c.a, c.b)
+		asserter.Equal(c.diffs, a.Subtract(b).String(), "%s subtract %s", c.a, c.b)
+	}
+
+	// an empty result selects no fields, unlike an empty filter.
+	none := mustParse("A").Intersect(mustParse("B"))
+	asserter.True(none.selectsNone())
+	asserter.True(mustParse("A").Subtract(mustParse("A")).selectsNone())
+	asserter.False(mustParse("").Intersect(mustParse("A")).selectsNone())
+	asserter.Equal("A", none.Merge(mustParse("A")).String())
+	asserter.True(none.Intersect(mustParse("A")).selectsNone())
+
+	// operations never modify the operands.
+	a, b := mustParse("A[B,C]"), mustParse("A[C,D]")
+	_ = a.Merge(b)
+	_ = a.Subtract(b)
+	asserter.Equal("A[B,C]", a.String())
+	asserter.Equal("A[C,D]", b.String())
+}
+
+func TestFilter_Levels(t *testing.T) {
+	asserter := assert.New(t)
+
+	f, err := ParseFilter("A,B[C,D],E[F],G")
+	asserter.Nil(err)
+
+	expected, err := parseFilters([]string{"A,B[C,D],E[F],G"})
+	asserter.Nil(err)
+	asserter.Equal(expected, f.levels())
+
+	asserter.Nil((&Filter{}).levels())
 }
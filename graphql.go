@@ -0,0 +1,650 @@
+package portal
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ParseGraphQLFilter parses a GraphQL query document and converts the
+// selection set of an operation into a filter for schema. Selected
+// field names are mapped to schema fields through their aliases (the
+// `json` tag by default), fields unknown to the schema are ignored.
+// Fragments and inline fragments are merged into the selection.
+//
+// Example:
+// ```
+// query := `query { task(id: 1) { id title user { ...userFields } } }
+// fragment userFields on User { name }`
+//
+// f, err := ParseGraphQLFilter(query, &TaskSchema{}, GraphQLPath("task"))
+// // f.String() == "ID,Title,User[Name]"
+// err = Dump(&taskSchema, &task, OnlyFilter(f))
+// ```
+func ParseGraphQLFilter(query string, schema interface{}, opts ...graphQLOption) (*Filter, error) {
+	cfg := &graphQLConfig{aliasTagName: "json"}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	typ, err := innerStructType(reflect.TypeOf(schema))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	doc, err := parseGraphQLDocument(query)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	op, err := doc.operation(cfg.operationName)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	selections, err := doc.flatten(op.selections, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	for _, name := range cfg.path {
+		var next []*graphQLSelection
+		for _, sel := range selections {
+			if sel.responseName() == name {
+				next = append(next, sel.children...)
+			}
+		}
+		if len(next) == 0 {
+			return nil, errors.Errorf("graphql: field '%s' not found in selection set", name)
+		}
+
+		selections, err = doc.flatten(next, nil)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	nodes, err := cfg.mapSelections(doc, typ, selections, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// e.g. `{ task { __typename } }`, selects no fields instead of all fields.
+	return &Filter{roots: nodes, none: len(nodes) == 0}, nil
+}
+
+type graphQLConfig struct {
+	operationName string
+	path          []string
+	aliasTagName  string
+}
+
+type graphQLOption func(cfg *graphQLConfig)
+
+// GraphQLOperation selects the operation by name if the document
+// contains more than one operation.
+func GraphQLOperation(name string) graphQLOption {
+	return func(cfg *graphQLConfig) {
+		cfg.operationName = name
+	}
+}
+
+// GraphQLPath selects the sub selection set to convert, by response names
+// (aliases are respected) from the operation root.
+func GraphQLPath(path ...string) graphQLOption {
+	return func(cfg *graphQLConfig) {
+		cfg.path = path
+	}
+}
+
+// GraphQLAliasTagName sets the tag name used to map GraphQL field names to
+// schema fields, it's `json` by default.
+func GraphQLAliasTagName(tag string) graphQLOption {
+	return func(cfg *graphQLConfig) {
+		cfg.aliasTagName = tag
+	}
+}
+
+func (cfg *graphQLConfig) mapSelections(doc *graphQLDocument, typ reflect.Type, selections []*graphQLSelection, parent *filterNode) ([]*filterNode, error) {
+	var nodes []*filterNode
+	for _, sel := range selections {
+		field, ok := cfg.schemaFieldByAlias(typ, sel.name)
+		if !ok {
+			logger.Debugf("[portal.graphql] field '%s' not found in '%s', ignored", sel.name, typ.Name())
+			continue
+		}
+
+		node := findFilterNode(nodes, field.Name)
+		if node == nil {
+			node = &filterNode{Name: field.Name, Parent: parent}
+			nodes = append(nodes, node)
+		}
+
+		if len(sel.children) == 0 {
+			continue
+		}
+
+		nestedType, err := indirectStructTypeE(field.Type)
+		if err != nil {
+			// not a nested schema, sub selections make no sense here.
+			continue
+		}
+
+		children, err := doc.flatten(sel.children, nil)
+		if err != nil {
+			return nil, err
+		}
+		mapped, err := cfg.mapSelections(doc, nestedType, children, node)
+		if err != nil {
+			return nil, err
+		}
+		node.Children = mergeFilterNodes(node.Children, mapped, node)
+		// e.g. `user { __typename }`, selects none of the nested fields
+		// instead of the whole nested schema.
+		node.None = len(node.Children) == 0
+	}
+	return nodes, nil
+}
+
+func (cfg *graphQLConfig) schemaFieldByAlias(typ reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if f.Anonymous {
+			embedded, err := indirectStructTypeE(f.Type)
+			if err == nil {
+				if ef, ok := cfg.schemaFieldByAlias(embedded, name); ok {
+					return ef, true
+				}
+			}
+			continue
+		}
+
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+
+		if parseAlias(f.Tag.Get(cfg.aliasTagName)) == name || f.Name == name {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+type graphQLSelection struct {
+	alias    string
+	name     string
+	children []*graphQLSelection
+
+	// fragment spread or inline fragment
+	fragment string
+	inline   bool
+}
+
+func (sel *graphQLSelection) responseName() string {
+	if sel.alias != "" {
+		return sel.alias
+	}
+	return sel.name
+}
+
+type graphQLOperation struct {
+	name       string
+	selections []*graphQLSelection
+}
+
+type graphQLDocument struct {
+	operations []*graphQLOperation
+	fragments  map[string][]*graphQLSelection
+}
+
+func (doc *graphQLDocument) operation(name string) (*graphQLOperation, error) {
+	if name == "" {
+		if len(doc.operations) != 1 {
+			return nil, errors.Errorf("graphql: operation name is required for a document with %d operations", len(doc.operations))
+		}
+		return doc.operations[0], nil
+	}
+
+	for _, op := range doc.operations {
+		if op.name == name {
+			return op, nil
+		}
+	}
+	return nil, errors.Errorf("graphql: operation '%s' not found", name)
+}
+
+// flatten expands fragment spreads and inline fragments to plain fields.
+func (doc *graphQLDocument) flatten(selections []*graphQLSelection, visiting map[string]bool) ([]*graphQLSelection, error) {
+	var result []*graphQLSelection
+	for _, sel := range selections {
+		switch {
+		case sel.inline:
+			children, err := doc.flatten(sel.children, visiting)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, children...)
+		case sel.fragment != "":
+			if visiting[sel.fragment] {
+				return nil, errors.Errorf("graphql: fragment '%s' spreads itself", sel.fragment)
+			}
+			fragment, ok := doc.fragments[sel.fragment]
+			if !ok {
+				return nil, errors.Errorf("graphql: fragment '%s' not found", sel.fragment)
+			}
+
+			nextVisiting := map[string]bool{sel.fragment: true}
+			for k := range visiting {
+				nextVisiting[k] = true
+			}
+			children, err := doc.flatten(fragment, nextVisiting)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, children...)
+		default:
+			result = append(result, sel)
+		}
+	}
+	return result, nil
+}
+
+type graphQLTokenKind int
+
+const (
+	graphQLEOF graphQLTokenKind = iota
+	graphQLPunct
+	graphQLName
+	graphQLNumber
+	graphQLString
+)
+
+type graphQLToken struct {
+	kind  graphQLTokenKind
+	value string
+	pos   int
+}
+
+func (t graphQLToken) String() string {
+	if t.kind == graphQLEOF {
+		return "<EOF>"
+	}
+	return t.value
+}
+
+type graphQLLexer struct {
+	src []byte
+	pos int
+}
+
+func isGraphQLNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isGraphQLNameContinue(c byte) bool {
+	return isGraphQLNameStart(c) || (c >= '0' && c <= '9')
+}
+
+func (l *graphQLLexer) next() (graphQLToken, error) {
+	// skip ignored tokens: whitespaces, line terminators, commas and comments.
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			l.pos++
+		} else if c == '#' {
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' && l.src[l.pos] != '\r' {
+				l.pos++
+			}
+		} else {
+			break
+		}
+	}
+
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return graphQLToken{kind: graphQLEOF, pos: start}, nil
+	}
+
+	c := l.src[l.pos]
+	switch {
+	case c == '.':
+		if l.pos+2 < len(l.src) && l.src[l.pos+1] == '.' && l.src[l.pos+2] == '.' {
+			l.pos += 3
+			return graphQLToken{kind: graphQLPunct, value: "...", pos: start}, nil
+		}
+		return graphQLToken{}, fmt.Errorf("graphql: unexpected character '.' at offset %d", start)
+	case c == '!' || c == '$' || c == '&' || c == '(' || c == ')' || c == ':' || c == '=' ||
+		c == '@' || c == '[' || c == ']' || c == '{' || c == '|' || c == '}':
+		l.pos++
+		return graphQLToken{kind: graphQLPunct, value: string(c), pos: start}, nil
+	case isGraphQLNameStart(c):
+		for l.pos < len(l.src) && isGraphQLNameContinue(l.src[l.pos]) {
+			l.pos++
+		}
+		return graphQLToken{kind: graphQLName, value: string(l.src[start:l.pos]), pos: start}, nil
+	case c == '-' || (c >= '0' && c <= '9'):
+		l.pos++
+		for l.pos < len(l.src) {
+			c := l.src[l.pos]
+			if (c >= '0' && c <= '9') || c == '.' || c == 'e' || c == 'E' || c == '+' || c == '-' {
+				l.pos++
+			} else {
+				break
+			}
+		}
+		return graphQLToken{kind: graphQLNumber, value: string(l.src[start:l.pos]), pos: start}, nil
+	case c == '"':
+		return l.readString()
+	default:
+		return graphQLToken{}, fmt.Errorf("graphql: unexpected character '%c' at offset %d", c, start)
+	}
+}
+
+func (l *graphQLLexer) readString() (graphQLToken, error) {
+	start := l.pos
+	if l.pos+2 < len(l.src) && l.src[l.pos+1] == '"' && l.src[l.pos+2] == '"' {
+		// block string
+		l.pos += 3
+		for l.pos+2 < len(l.src) {
+			if l.src[l.pos] == '\\' && l.pos+3 < len(l.src) && string(l.src[l.pos+1:l.pos+4]) == `"""` {
+				l.pos += 4
+				continue
+			}
+			if string(l.src[l.pos:l.pos+3]) == `"""` {
+				l.pos += 3
+				return graphQLToken{kind: graphQLString, value: string(l.src[start:l.pos]), pos: start}, nil
+			}
+			l.pos++
+		}
+		return graphQLToken{}, fmt.Errorf("graphql: unterminated string at offset %d", start)
+	}
+
+	l.pos++
+	for l.pos < len(l.src) {
+		switch l.src[l.pos] {
+		case '\\':
+			l.pos += 2
+		case '"':
+			l.pos++
+			return graphQLToken{kind: graphQLString, value: string(l.src[start:l.pos]), pos: start}, nil
+		case '\n', '\r':
+			return graphQLToken{}, fmt.Errorf("graphql: unterminated string at offset %d", start)
+		default:
+			l.pos++
+		}
+	}
+	return graphQLToken{}, fmt.Errorf("graphql: unterminated string at offset %d", start)
+}
+
+type graphQLParser struct {
+	lexer *graphQLLexer
+	tok   graphQLToken
+}
+
+func parseGraphQLDocument(query string) (*graphQLDocument, error) {
+	query = strings.TrimPrefix(query, "\uFEFF")
+	p := &graphQLParser{lexer: &graphQLLexer{src: []byte(query)}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	doc := &graphQLDocument{fragments: make(map[string][]*graphQLSelection)}
+	for p.tok.kind != graphQLEOF {
+		switch {
+		case p.peek(graphQLPunct, "{"):
+			selections, err := p.parseSelectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &graphQLOperation{selections: selections})
+		case p.peek(graphQLName, "query"), p.peek(graphQLName, "mutation"), p.peek(graphQLName, "subscription"):
+			op, err := p.parseOperation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case p.peek(graphQLName, "fragment"):
+			name, selections, err := p.parseFragment()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := doc.fragments[name]; ok {
+				return nil, errors.Errorf("graphql: fragment '%s' is defined more than once", name)
+			}
+			doc.fragments[name] = selections
+		default:
+			return nil, p.unexpected()
+		}
+	}
+
+	if len(doc.operations) == 0 {
+		return nil, errors.New("graphql: no operation found")
+	}
+	return doc, nil
+}
+
+func (p *graphQLParser) advance() error {
+	tok, err := p.lexer.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *graphQLParser) peek(kind graphQLTokenKind, value string) bool {
+	return p.tok.kind == kind && p.tok.value == value
+}
+
+func (p *graphQLParser) unexpected() error {
+	return fmt.Errorf("graphql: unexpected token '%s' at offset %d", p.tok, p.tok.pos)
+}
+
+func (p *graphQLParser) expect(kind graphQLTokenKind, value string) error {
+	if !p.peek(kind, value) {
+		return p.unexpected()
+	}
+	return p.advance()
+}
+
+func (p *graphQLParser) expectName() (string, error) {
+	if p.tok.kind != graphQLName {
+		return "", p.unexpected()
+	}
+	name := p.tok.value
+	return name, p.advance()
+}
+
+func (p *graphQLParser) parseOperation() (*graphQLOperation, error) {
+	// skip operation type
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	op := &graphQLOperation{}
+	if p.tok.kind == graphQLName {
+		op.name = p.tok.value
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.peek(graphQLPunct, "(") {
+		// variable definitions are not needed.
+		if err := p.skipBalanced("(", ")"); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.skipDirectives(); err != nil {
+		return nil, err
+	}
+
+	selections, err := p.parseSelectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.selections = selections
+	return op, nil
+}
+
+func (p *graphQLParser) parseFragment() (string, []*graphQLSelection, error) {
+	// skip keyword `fragment`
+	if err := p.advance(); err != nil {
+		return "", nil, err
+	}
+
+	name, err := p.expectName()
+	if err != nil {
+		return "", nil, err
+	}
+	if name == "on" {
+		return "", nil, fmt.Errorf("graphql: invalid fragment name 'on' at offset %d", p.tok.pos)
+	}
+
+	if err := p.expect(graphQLName, "on"); err != nil {
+		return "", nil, err
+	}
+	if _, err := p.expectName(); err != nil {
+		return "", nil, err
+	}
+
+	if err := p.skipDirectives(); err != nil {
+		return "", nil, err
+	}
+
+	selections, err := p.parseSelectionSet()
+	if err != nil {
+		return "", nil, err
+	}
+	return name, selections, nil
+}
+
+func (p *graphQLParser) parseSelectionSet() ([]*graphQLSelection, error) {
+	if err := p.expect(graphQLPunct, "{"); err != nil {
+		return nil, err
+	}
+
+	var selections []*graphQLSelection
+	for !p.peek(graphQLPunct, "}") {
+		sel, err := p.parseSelection()
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, sel)
+	}
+
+	if len(selections) == 0 {
+		return nil, p.unexpected()
+	}
+	return selections, p.advance()
+}
+
+func (p *graphQLParser) parseSelection() (*graphQLSelection, error) {
+	if p.peek(graphQLPunct, "...") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+
+		if p.tok.kind == graphQLName && p.tok.value != "on" {
+			sel := &graphQLSelection{fragment: p.tok.value}
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			return sel, p.skipDirectives()
+		}
+
+		if p.peek(graphQLName, "on") {
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			if _, err := p.expectName(); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := p.skipDirectives(); err != nil {
+			return nil, err
+		}
+		children, err := p.parseSelectionSet()
+		if err != nil {
+			return nil, err
+		}
+		return &graphQLSelection{inline: true, children: children}, nil
+	}
+
+	name, err := p.expectName()
+	if err != nil {
+		return nil, err
+	}
+
+	sel := &graphQLSelection{name: name}
+	if p.peek(graphQLPunct, ":") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		sel.alias = name
+		if sel.name, err = p.expectName(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.peek(graphQLPunct, "(") {
+		// arguments don't affect the selected fields.
+		if err := p.skipBalanced("(", ")"); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.skipDirectives(); err != nil {
+		return nil, err
+	}
+
+	if p.peek(graphQLPunct, "{") {
+		if sel.children, err = p.parseSelectionSet(); err != nil {
+			return nil, err
+		}
+	}
+	return sel, nil
+}
+
+func (p *graphQLParser) skipDirectives() error {
+	for p.peek(graphQLPunct, "@") {
+		if err := p.advance(); err != nil {
+			return err
+		}
+		if _, err := p.expectName(); err != nil {
+			return err
+		}
+		if p.peek(graphQLPunct, "(") {
+			if err := p.skipBalanced("(", ")"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// skipBalanced skips tokens until the matched close punctuator.
+func (p *graphQLParser) skipBalanced(open, close string) error {
+	depth := 0
+	for {
+		switch {
+		case p.tok.kind == graphQLEOF:
+			return p.unexpected()
+		case p.peek(graphQLPunct, open):
+			depth++
+		case p.peek(graphQLPunct, close):
+			depth--
+		}
+
+		if err := p.advance(); err != nil {
+			return err
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
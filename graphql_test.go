@@ -0,0 +1,141 @@
+package portal
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseGraphQLFilter(t *testing.T) {
+	asserter := assert.New(t)
+
+	query := `
+# fetch a task
+query GetTask($id: ID!, $withUser: Boolean = true) {
+  task(id: $id, filter: {tags: ["a", "b"], note: "has } and )"}) {
+    id
+    headline: title
+    ... on Task @include(if: $withUser) {
+      user {
+        ...userFields
+      }
+    }
+    simple_user { __typename }
+    unknown_field
+  }
+}
+
+fragment userFields on User {
+  name
+  notifications(first: 10) { id title }
+  notifications { content }
+}
+`
+	f, err := ParseGraphQLFilter(query, &TaskSchema{}, GraphQLPath("task"))
+	asserter.Nil(err)
+	asserter.Equal("ID,Title,User[Name,Notifications[ID,Title,Content]],SimpleUser[]", f.String())
+
+	task := TaskModel{ID: 1, UserID: 1, Title: "Finish your jobs."}
+	simpleOnly, err := ParseFilter("SimpleUser")
+	asserter.Nil(err)
+	var simple TaskSchema
+	err = Dump(&simple, &task, OnlyFilter(f.Intersect(simpleOnly)))
+	asserter.Nil(err)
+	data, _ := json.Marshal(simple)
+	asserter.Equal(`{"simple_user":{},"unknown":""}`, string(data))
+
+	f, err = ParseGraphQLFilter(`{ id description user { id } }`, &TaskSchema{})
+	asserter.Nil(err)
+	asserter.Equal("ID,Description,User[ID]", f.String())
+
+	var taskSchema TaskSchema
+	err = Dump(&taskSchema, &task, OnlyFilter(f))
+	asserter.Nil(err)
+	data, _ = json.Marshal(taskSchema)
+	asserter.Equal(`{"id":"1","description":"Custom description","user":{"id":"1"},"unknown":""}`, string(data))
+}
+
+func TestParseGraphQLFilter_NoKnownFields(t *testing.T) {
+	asserter := assert.New(t)
+
+	task := TaskModel{ID: 1, UserID: 1, Title: "Finish your jobs."}
+	for _, query := range []string{`{ task { __typename } }`, `{ task { unknownField } }`} {
+		f, err := ParseGraphQLFilter(query, &TaskSchema{}, GraphQLPath("task"))
+		asserter.Nil(err)
+		asserter.Equal("", f.String())
+
+		var taskSchema TaskSchema
+		err = Dump(&taskSchema, &task, OnlyFilter(f))
+		asserter.Nil(err)
+		asserter.Equal(TaskSchema{}, taskSchema, query)
+	}
+}
+
+func TestParseGraphQLFilter_Operations(t *testing.T) {
+	asserter := assert.New(t)
+
+	query := `
+query A { task { id } }
+query B { t: task { title } }
+`
+	_, err := ParseGraphQLFilter(query, &TaskSchema{})
+	asserter.NotNil(err)
+
+	f, err := ParseGraphQLFilter(query, &TaskSchema{}, GraphQLOperation("B"), GraphQLPath("t"))
+	asserter.Nil(err)
+	asserter.Equal("Title", f.String())
+
+	_, err = ParseGraphQLFilter(query, &TaskSchema{}, GraphQLOperation("B"), GraphQLPath("task"))
+	asserter.NotNil(err)
+
+	_, err = ParseGraphQLFilter(query, &TaskSchema{}, GraphQLOperation("C"))
+	asserter.NotNil(err)
+}
+
+func TestParseGraphQLFilter_AliasTagName(t *testing.T) {
+	type FooSchema struct {
+		PersonSchema
+		Name string `yaml:"full_name"`
+	}
+
+	f, err := ParseGraphQLFilter(`{ full_name id age }`, FooSchema{}, GraphQLAliasTagName("yaml"))
+	assert.Nil(t, err)
+	assert.Equal(t, "Name", f.String())
+
+	f, err = ParseGraphQLFilter(`{ full_name id age }`, FooSchema{})
+	assert.Nil(t, err)
+	assert.Equal(t, "ID,Age", f.String())
+}
+
+func TestParseGraphQLFilter_Errors(t *testing.T) {
+	cases := []string{
+		``,
+		`{ }`,
+		`{ id `,
+		`{ id(a: 1 }`,
+		`{ ...missing }`,
+		`{ ...a } fragment a on T { ...b } fragment b on T { ...a }`,
+		`{ id } fragment a on T { id } fragment a on T { id }`,
+		`{ id: }`,
+		`{ "id" }`,
+		`{ id(a: "unterminated) }`,
+		`{ id ~ }`,
+	}
+
+	for _, c := range cases {
+		_, err := ParseGraphQLFilter(c, &TaskSchema{})
+		assert.NotNil(t, err, c)
+	}
+
+	_, err := ParseGraphQLFilter(`{ id }`, 1)
+	assert.NotNil(t, err)
+}
+
+func TestParseGraphQLDocument_ErrorOffset(t *testing.T) {
+	_, err := parseGraphQLDocument(`{ id: }`)
+	assert.EqualError(t, err, "graphql: unexpected token '}' at offset 6")
+
+	_, err = parseGraphQLDocument(`{ id ~ }`)
+	assert.EqualError(t, err, "graphql: unexpected character '~' at offset 5")
+}
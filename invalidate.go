@@ -0,0 +1,292 @@
+package portal
+
+import (
+	"container/list"
+	"context"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	identityTagPrefix = "id:"
+	methodTagPrefix   = "method:"
+	customTagPrefix   = "tag:"
+)
+
+// cacheIndex indexes keys stored in the configured caches by invalidation tags:
+// the identities of models, the methods and the tags of tag option `cachetags`.
+// It only knows keys set by the current process in caches implementing Deleter,
+// after invalidation is enabled by `SetCacheInvalidation`. Keys are dropped when
+// they are invalidated, evicted by LRUCache or expired in MapCache, and the
+// oldest ones are dropped if the index exceeds its limit.
+type cacheIndex struct {
+	mu    sync.Mutex
+	tags  map[string]map[cacheRef]struct{}
+	refs  map[cacheRef]*list.Element
+	order *list.List
+	limit int
+}
+
+type cacheRef struct {
+	cache Cacher
+	key   string
+}
+
+type cacheIndexEntry struct {
+	ref  cacheRef
+	tags []string
+}
+
+const defaultCacheIndexLimit = 100000
+
+var (
+	defaultCacheIndex = newCacheIndex(defaultCacheIndexLimit)
+	// cacheInvalidation is set to 1 by SetCacheInvalidation, keys
+	// are indexed only if it's enabled.
+	cacheInvalidation int32
+)
+
+// ErrCacheInvalidationDisabled is returned by `Invalidate`, `InvalidateMethod`
+// and `InvalidateTags` if invalidation isn't enabled by `SetCacheInvalidation`.
+var ErrCacheInvalidationDisabled = errors.New("cache invalidation is disabled, enable it by portal.SetCacheInvalidation(true)")
+
+func newCacheIndex(limit int) *cacheIndex {
+	return &cacheIndex{
+		tags:  make(map[string]map[cacheRef]struct{}),
+		refs:  make(map[cacheRef]*list.Element),
+		order: list.New(),
+		limit: limit,
+	}
+}
+
+// SetCacheIndexLimit limits the number of keys indexed for invalidation,
+// 100000 by default. Values of the oldest keys dropped from the index are
+// not removed by `Invalidate`, so combine the limit with a TTL. Zero means no limit.
+func SetCacheIndexLimit(limit int) {
+	defaultCacheIndex.setLimit(limit)
+}
+
+// SetCacheInvalidation enables indexing keys set in the shared cache, which
+// is required by `Invalidate`. It's disabled by default, so that dumps don't pay
+// for the index. Enable it before dumping, keys set earlier can't be invalidated.
+// Disabling it drops the index.
+func SetCacheInvalidation(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&cacheInvalidation, 1)
+		return
+	}
+	atomic.StoreInt32(&cacheInvalidation, 0)
+	defaultCacheIndex.clear()
+}
+
+func isCacheInvalidationEnabled() bool {
+	return atomic.LoadInt32(&cacheInvalidation) == 1
+}
+
+func invalidationTags(ck *cacheKey) []string {
+	tags := make([]string, 0, len(ck.identities)+1)
+	for _, id := range ck.identities {
+		tags = append(tags, identityTagPrefix+id)
+	}
+	tags = append(tags, methodTagPrefix+ck.namespace+"."+ck.method)
+	if ck.opt != nil {
+		for _, tag := range ck.opt.tags {
+			tags = append(tags, customTagPrefix+tag)
+		}
+	}
+	return tags
+}
+
+// add indexes the key set in the cache, if invalidation is enabled
+// and the cache implements Deleter.
+func (idx *cacheIndex) add(cache Cacher, ck *cacheKey) {
+	if !isCacheInvalidationEnabled() {
+		return
+	}
+	if _, ok := cache.(Deleter); !ok {
+		return
+	}
+	if !reflect.TypeOf(cache).Comparable() {
+		logger.Debugf("[portal.cache] cache '%T' is not comparable, cannot be invalidated", cache)
+		return
+	}
+
+	ref := cacheRef{cache: cache, key: ck.sharedKey()}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if elem, ok := idx.refs[ref]; ok {
+		idx.order.MoveToFront(elem)
+		return
+	}
+
+	tags := invalidationTags(ck)
+	idx.refs[ref] = idx.order.PushFront(&cacheIndexEntry{ref: ref, tags: tags})
+	for _, tag := range tags {
+		refs, ok := idx.tags[tag]
+		if !ok {
+			refs = make(map[cacheRef]struct{})
+			idx.tags[tag] = refs
+		}
+		refs[ref] = struct{}{}
+	}
+	idx.shrink()
+}
+
+// clear drops all indexed keys.
+func (idx *cacheIndex) clear() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.tags = make(map[string]map[cacheRef]struct{})
+	idx.refs = make(map[cacheRef]*list.Element)
+	idx.order.Init()
+}
+
+func (idx *cacheIndex) setLimit(limit int) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.limit = limit
+	idx.shrink()
+}
+
+// shrink drops the oldest refs until the limit is satisfied.
+func (idx *cacheIndex) shrink() {
+	for idx.limit > 0 && idx.order.Len() > idx.limit {
+		entry := idx.order.Back().Value.(*cacheIndexEntry)
+		logger.Debugf("[portal.cache] cache index is full, drop key '%s'", entry.ref.key)
+		idx.removeRef(entry.ref)
+	}
+}
+
+// removeRef removes the ref, the lock must be held.
+func (idx *cacheIndex) removeRef(ref cacheRef) {
+	elem, ok := idx.refs[ref]
+	if !ok {
+		return
+	}
+
+	for _, t := range elem.Value.(*cacheIndexEntry).tags {
+		delete(idx.tags[t], ref)
+		if len(idx.tags[t]) == 0 {
+			delete(idx.tags, t)
+		}
+	}
+	idx.order.Remove(elem)
+	delete(idx.refs, ref)
+}
+
+// forget removes the key removed by the cache itself, e.g. evicted or expired.
+func (idx *cacheIndex) forget(cache Cacher, key interface{}) {
+	if !isCacheInvalidationEnabled() {
+		return
+	}
+	k, ok := key.(string)
+	if !ok {
+		return
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.removeRef(cacheRef{cache: cache, key: k})
+}
+
+// len returns the number of indexed keys.
+func (idx *cacheIndex) len() int {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.order.Len()
+}
+
+// remove removes the refs of the tags from the index, and returns them.
+func (idx *cacheIndex) remove(tags ...string) []cacheRef {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	var result []cacheRef
+	for _, tag := range tags {
+		for ref := range idx.tags[tag] {
+			result = append(result, ref)
+			idx.removeRef(ref)
+		}
+	}
+	return result
+}
+
+func (idx *cacheIndex) invalidate(ctx context.Context, tags ...string) error {
+	if !isCacheInvalidationEnabled() {
+		return ErrCacheInvalidationDisabled
+	}
+
+	keysByCache := make(map[Cacher][]interface{})
+	for _, ref := range idx.remove(tags...) {
+		keysByCache[ref.cache] = append(keysByCache[ref.cache], ref.key)
+	}
+
+	var firstErr error
+	for cache, keys := range keysByCache {
+		if err := deleteKeys(ctx, cache, keys...); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func deleteKeys(ctx context.Context, cache Cacher, keys ...interface{}) error {
+	deleter, ok := cache.(Deleter)
+	if !ok {
+		return errors.Errorf("cache '%T' doesn't implement portal.Deleter", cache)
+	}
+	return errors.WithStack(deleter.Delete(ctx, keys...))
+}
+
+// Invalidate removes cached values derived from the models, including values of
+// attribute chains starting from them. The models must implement CacheIdentifier.
+// Invalidation must be enabled by `SetCacheInvalidation` before dumping.
+// Only values set by the current process are known, and the index is
+// bounded by `SetCacheIndexLimit`, combine it with a TTL if the cache is shared
+// by multiple processes.
+// Example:
+// ```
+// db.Save(&user)
+// portal.Invalidate(ctx, &user)
+// ```
+func Invalidate(ctx context.Context, models ...interface{}) error {
+	tags := make([]string, 0, len(models))
+	for _, model := range models {
+		id, ok := portalCacheID(model)
+		if !ok {
+			return errors.Errorf("'%s' doesn't implement portal.CacheIdentifier", typeName(model))
+		}
+		tags = append(tags, identityTagPrefix+typeName(model)+":"+id)
+	}
+	return defaultCacheIndex.invalidate(ctx, tags...)
+}
+
+// InvalidateMethod removes cached values of the method of a schema (for `meth`)
+// or a model (for `attr`), receiver is a value of the schema or model type.
+// Example:
+// ```
+// portal.InvalidateMethod(ctx, &schema.TaskSchema{}, "GetDescription")
+// ```
+func InvalidateMethod(ctx context.Context, receiver interface{}, methodName string) error {
+	return defaultCacheIndex.invalidate(ctx, methodTagPrefix+pkgPath(receiver)+"."+structName(receiver)+"#"+methodName)
+}
+
+// InvalidateTags removes cached values of fields tagged by tag option `cachetags`.
+// Example:
+// ```
+// // Followers int `json:"followers" portal:"meth:CountFollowers;cachetags:follow"`
+// portal.InvalidateTags(ctx, "follow")
+// ```
+func InvalidateTags(ctx context.Context, tags ...string) error {
+	prefixed := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		prefixed = append(prefixed, customTagPrefix+tag)
+	}
+	return defaultCacheIndex.invalidate(ctx, prefixed...)
+}
@@ -0,0 +1,205 @@
+package portal
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type TaggedSchema struct {
+	Name      string `portal:"meth:GetName;cachetags:name"`
+	Followers int    `portal:"meth:CountFollowers;cachetags:follow,user"`
+}
+
+func (s *TaggedSchema) GetName(m *countedModel) string {
+	atomic.AddInt32(m.calls, 1)
+	return "name"
+}
+
+func (s *TaggedSchema) CountFollowers(m *countedModel) int {
+	atomic.AddInt32(m.calls, 1)
+	return 1
+}
+
+// enableCacheInvalidation enables invalidation, and returns a function to
+// disable it and drop the index.
+func enableCacheInvalidation() func() {
+	SetCacheInvalidation(true)
+	return func() {
+		SetCacheInvalidation(false)
+		defaultCacheIndex = newCacheIndex(defaultCacheIndexLimit)
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	defer enableCacheInvalidation()()
+	ctx := context.TODO()
+	cache := NewLRUCache(100, 0)
+	SetCache(cache)
+	defer SetCache(nil)
+
+	var calls int32
+	dump := func(id int) {
+		var dst CountedSchema
+		require.Nil(t, Dump(&dst, &countedModel{ID: id, calls: &calls}))
+	}
+
+	dump(1)
+	dump(2)
+	dump(1)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+
+	require.Nil(t, Invalidate(ctx, &countedModel{ID: 1}))
+	assert.Equal(t, 2, cache.Len())
+	dump(1)
+	dump(2)
+	assert.Equal(t, int32(6), atomic.LoadInt32(&calls))
+
+	require.Nil(t, InvalidateMethod(ctx, &CountedSchema{}, "GetName"))
+	assert.Equal(t, 2, cache.Len())
+	dump(1)
+	dump(2)
+	assert.Equal(t, int32(8), atomic.LoadInt32(&calls))
+
+	// invalidated already
+	require.Nil(t, Invalidate(ctx, &countedModel{ID: 3}))
+	require.Nil(t, InvalidateMethod(ctx, &CountedSchema{}, "GetName"))
+	assert.Equal(t, 2, cache.Len())
+}
+
+func TestInvalidate_AttributeChain(t *testing.T) {
+	defer enableCacheInvalidation()()
+	ctx := context.TODO()
+	cache := newMapCache()
+
+	var dst IdentifiedSchema
+	require.Nil(t, Dump(&dst, &IdentifiedModel{ID: 1}, UseCache(cache)))
+	require.Nil(t, Dump(&dst, &IdentifiedModel{ID: 2}, UseCache(cache)))
+	assert.Equal(t, 6, cache.Len())
+
+	require.Nil(t, Invalidate(ctx, IdentifiedModel{ID: 1}))
+	assert.Equal(t, 3, cache.Len())
+	_, err := cache.Get(ctx, "portal:github.com/ifaceless/portal.Student#FullName#IdentifiedModel#Profile#IdentifiedModel:2")
+	assert.Nil(t, err)
+}
+
+func TestInvalidateTags(t *testing.T) {
+	defer enableCacheInvalidation()()
+	ctx := context.TODO()
+	cache := NewTieredCache(newMapCache(), NewByteStore(), JSONCodec)
+
+	var calls int32
+	dump := func() {
+		var dst TaggedSchema
+		require.Nil(t, Dump(&dst, &countedModel{ID: 1, calls: &calls}, UseCache(cache)))
+		assert.Equal(t, TaggedSchema{Name: "name", Followers: 1}, dst)
+	}
+
+	dump()
+	dump()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	require.Nil(t, InvalidateTags(ctx, "follow"))
+	dump()
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	require.Nil(t, InvalidateTags(ctx, "user", "name"))
+	dump()
+	assert.Equal(t, int32(5), atomic.LoadInt32(&calls))
+}
+
+type setGetOnlyCache struct {
+	m MapCache
+}
+
+func (c *setGetOnlyCache) Set(ctx context.Context, key, value interface{}) error {
+	return c.m.Set(ctx, key, value)
+}
+
+func (c *setGetOnlyCache) Get(ctx context.Context, key interface{}) (interface{}, error) {
+	return c.m.Get(ctx, key)
+}
+
+func TestInvalidate_Disabled(t *testing.T) {
+	ctx := context.TODO()
+	cache := newMapCache()
+
+	var calls int32
+	var dst CountedSchema
+	require.Nil(t, Dump(&dst, &countedModel{ID: 100, calls: &calls}, UseCache(cache)))
+	assert.Equal(t, 0, defaultCacheIndex.len())
+	assert.Equal(t, ErrCacheInvalidationDisabled, Invalidate(ctx, &countedModel{ID: 100}))
+	assert.Equal(t, ErrCacheInvalidationDisabled, InvalidateMethod(ctx, &CountedSchema{}, "GetName"))
+	assert.Equal(t, ErrCacheInvalidationDisabled, InvalidateTags(ctx, "follow"))
+	assert.Equal(t, 2, cache.Len())
+}
+
+func TestInvalidate_Error(t *testing.T) {
+	defer enableCacheInvalidation()()
+	ctx := context.TODO()
+	assert.EqualError(t, Invalidate(ctx, &Student{}), "'Student' doesn't implement portal.CacheIdentifier")
+
+	// keys of caches not implementing Deleter are not indexed.
+	var calls int32
+	var dst CountedSchema
+	require.Nil(t, Dump(&dst, &countedModel{ID: 100, calls: &calls}, UseCache(&setGetOnlyCache{})))
+	assert.Equal(t, 0, defaultCacheIndex.len())
+	assert.Nil(t, Invalidate(ctx, &countedModel{ID: 100}))
+}
+
+func TestCacheIndex_OnlyOnWrite(t *testing.T) {
+	defer enableCacheInvalidation()()
+	cache := newMapCache()
+
+	var calls int32
+	dump := func() {
+		var dst CountedSchema
+		require.Nil(t, Dump(&dst, &countedModel{ID: 1, calls: &calls}, UseCache(cache)))
+	}
+	dump()
+	assert.Equal(t, 2, defaultCacheIndex.len())
+
+	// values read from the shared cache, e.g. set by another process, are not indexed.
+	defaultCacheIndex = newCacheIndex(defaultCacheIndexLimit)
+	dump()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	assert.Equal(t, 0, defaultCacheIndex.len())
+}
+
+func TestCacheIndex_Bounded(t *testing.T) {
+	defer enableCacheInvalidation()()
+
+	var calls int32
+	dump := func(cache Cacher, id int) {
+		var dst CountedSchema
+		require.Nil(t, Dump(&dst, &countedModel{ID: id, calls: &calls}, UseCache(cache)))
+	}
+
+	// the oldest keys are dropped over the limit.
+	defaultCacheIndex = newCacheIndex(3)
+	for id := 1; id <= 5; id++ {
+		dump(newMapCache(), id)
+	}
+	assert.Equal(t, 3, defaultCacheIndex.len())
+
+	// keys evicted by LRUCache are dropped.
+	defaultCacheIndex = newCacheIndex(0)
+	lru := NewLRUCache(2, 0, LRUShards(1))
+	for id := 1; id <= 5; id++ {
+		dump(lru, id)
+	}
+	assert.Equal(t, lru.Len(), defaultCacheIndex.len())
+
+	// keys expired in MapCache are dropped, Title is cached for a minute.
+	defaultCacheIndex = newCacheIndex(0)
+	m := NewMapCache(time.Millisecond, 0)
+	dump(m, 1)
+	assert.Equal(t, 2, defaultCacheIndex.len())
+	time.Sleep(5 * time.Millisecond)
+	m.DeleteExpired()
+	assert.Equal(t, 1, defaultCacheIndex.len())
+}
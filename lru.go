@@ -0,0 +1,330 @@
+package portal
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultLRUShards = 16
+
+// LRUCache is a bounded, sharded Cacher which evicts the least
+// recently used entries when the number of entries or the estimated
+// bytes exceed the limits.
+type LRUCache struct {
+	numShards int
+	shards    []*lruShard
+	onEvict   func(key, value interface{})
+	sizeFunc  func(key, value interface{}) int64
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// CacheStats contains the statistics of a cache.
+type CacheStats struct {
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+type lruOption func(c *LRUCache)
+
+// LRUShards sets the number of shards, default to 16.
+func LRUShards(n int) lruOption {
+	return func(c *LRUCache) {
+		c.numShards = n
+	}
+}
+
+// LRUOnEvict sets a callback function called when an entry is
+// evicted because of the limits or expiry.
+// It's called without holding any lock of the cache.
+func LRUOnEvict(fn func(key, value interface{})) lruOption {
+	return func(c *LRUCache) {
+		c.onEvict = fn
+	}
+}
+
+// LRUSizeFunc sets the function estimating bytes of an entry, e.g. returns
+// the length of encoded bytes. By default, the size is estimated by walking
+// the value with reflection if maxBytes is set, which is costly for large values.
+func LRUSizeFunc(fn func(key, value interface{}) int64) lruOption {
+	return func(c *LRUCache) {
+		c.sizeFunc = fn
+	}
+}
+
+type lruShard struct {
+	mu         sync.Mutex
+	ll         *list.List
+	items      map[interface{}]*list.Element
+	bytes      int64
+	maxEntries int
+	maxBytes   int64
+}
+
+type lruEntry struct {
+	key      interface{}
+	value    interface{}
+	size     int64
+	expireAt time.Time
+}
+
+// NewLRUCache creates a LRUCache holding at most maxEntries entries
+// and maxBytes estimated bytes. Zero means no limit.
+// The limits are split evenly across shards. Bytes are not estimated
+// without maxBytes or `LRUSizeFunc`.
+// Example:
+// ```
+// cache := NewLRUCache(10000, 64<<20, LRUOnEvict(onEvict))
+// portal.SetCache(cache)
+// ```
+func NewLRUCache(maxEntries int, maxBytes int64, opts ...lruOption) *LRUCache {
+	c := &LRUCache{numShards: defaultLRUShards}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.sizeFunc == nil {
+		c.sizeFunc = noEntrySize
+		if maxBytes > 0 {
+			c.sizeFunc = estimateEntrySize
+		}
+	}
+
+	shards := c.numShards
+	if maxEntries > 0 && shards > maxEntries {
+		shards = maxEntries
+	}
+	if shards <= 0 {
+		shards = 1
+	}
+
+	c.shards = make([]*lruShard, shards)
+	for i := range c.shards {
+		c.shards[i] = &lruShard{
+			ll:         list.New(),
+			items:      make(map[interface{}]*list.Element),
+			maxEntries: ceilDiv(int64(maxEntries), int64(shards)),
+			maxBytes:   int64(ceilDiv(maxBytes, int64(shards))),
+		}
+	}
+	return c
+}
+
+func ceilDiv(a, b int64) int {
+	return int((a + b - 1) / b)
+}
+
+var _ Cacher = (*LRUCache)(nil)
+var _ TTLSetter = (*LRUCache)(nil)
+var _ Deleter = (*LRUCache)(nil)
+
+func (c *LRUCache) shard(key interface{}) *lruShard {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+
+	h := fnv.New32a()
+	switch k := key.(type) {
+	case string:
+		_, _ = h.Write([]byte(k))
+	default:
+		_, _ = fmt.Fprintf(h, "%v", k)
+	}
+	return c.shards[h.Sum32()%uint32(len(c.shards))]
+}
+
+func (c *LRUCache) Set(ctx context.Context, key, value interface{}) error {
+	return c.SetWithTTL(ctx, key, value, 0)
+}
+
+// SetWithTTL sets value with a ttl, the entry never expires if ttl is not positive.
+func (c *LRUCache) SetWithTTL(_ context.Context, key, value interface{}, ttl time.Duration) error {
+	entry := &lruEntry{key: key, value: value, size: c.sizeFunc(key, value)}
+	if ttl > 0 {
+		entry.expireAt = time.Now().Add(ttl)
+	}
+
+	s := c.shard(key)
+	s.mu.Lock()
+	if elem, ok := s.items[key]; ok {
+		old := elem.Value.(*lruEntry)
+		s.bytes += entry.size - old.size
+		elem.Value = entry
+		s.ll.MoveToFront(elem)
+	} else {
+		s.items[key] = s.ll.PushFront(entry)
+		s.bytes += entry.size
+	}
+	evicted := s.evictOverflow()
+	s.mu.Unlock()
+
+	c.evicted(evicted)
+	return nil
+}
+
+func (c *LRUCache) Get(_ context.Context, key interface{}) (interface{}, error) {
+	s := c.shard(key)
+	s.mu.Lock()
+	elem, ok := s.items[key]
+	if !ok {
+		s.mu.Unlock()
+		atomic.AddUint64(&c.misses, 1)
+		return nil, &ErrNil{}
+	}
+
+	entry := elem.Value.(*lruEntry)
+	if !entry.expireAt.IsZero() && !time.Now().Before(entry.expireAt) {
+		s.removeElement(elem)
+		s.mu.Unlock()
+		atomic.AddUint64(&c.misses, 1)
+		c.evicted([]*lruEntry{entry})
+		return nil, &ErrNil{}
+	}
+
+	s.ll.MoveToFront(elem)
+	s.mu.Unlock()
+	atomic.AddUint64(&c.hits, 1)
+	return entry.value, nil
+}
+
+// Delete removes the keys, the OnEvict callback is not called.
+func (c *LRUCache) Delete(_ context.Context, keys ...interface{}) error {
+	for _, key := range keys {
+		s := c.shard(key)
+		s.mu.Lock()
+		if elem, ok := s.items[key]; ok {
+			s.removeElement(elem)
+		}
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// Len returns the number of entries.
+func (c *LRUCache) Len() int {
+	n := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		n += s.ll.Len()
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// Stats returns the statistics of the cache. It can be published
+// with `expvar`, e.g. `expvar.Publish("portal_cache", expvar.Func(func() interface{} { return cache.Stats() }))`.
+func (c *LRUCache) Stats() CacheStats {
+	stats := CacheStats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+	}
+	for _, s := range c.shards {
+		s.mu.Lock()
+		stats.Entries += s.ll.Len()
+		stats.Bytes += s.bytes
+		s.mu.Unlock()
+	}
+	return stats
+}
+
+func (c *LRUCache) evicted(entries []*lruEntry) {
+	if len(entries) == 0 {
+		return
+	}
+
+	atomic.AddUint64(&c.evictions, uint64(len(entries)))
+	for _, e := range entries {
+		defaultCacheIndex.forget(c, e.key)
+		if c.onEvict != nil {
+			c.onEvict(e.key, e.value)
+		}
+	}
+}
+
+// evictOverflow removes the oldest entries until the limits are satisfied.
+// The most recent entry is always kept even if it's larger than maxBytes.
+func (s *lruShard) evictOverflow() (evicted []*lruEntry) {
+	for s.ll.Len() > 1 &&
+		((s.maxEntries > 0 && s.ll.Len() > s.maxEntries) || (s.maxBytes > 0 && s.bytes > s.maxBytes)) {
+		elem := s.ll.Back()
+		evicted = append(evicted, elem.Value.(*lruEntry))
+		s.removeElement(elem)
+	}
+	return
+}
+
+func (s *lruShard) removeElement(elem *list.Element) {
+	entry := elem.Value.(*lruEntry)
+	s.ll.Remove(elem)
+	delete(s.items, entry.key)
+	s.bytes -= entry.size
+}
+
+func noEntrySize(_, _ interface{}) int64 {
+	return 0
+}
+
+// estimateEntrySize estimates the memory used by the key and value.
+// It's an approximation, shared memory and map overhead are not precisely counted.
+func estimateEntrySize(key, value interface{}) int64 {
+	visited := make(map[uintptr]bool)
+	return estimateSize(reflect.ValueOf(key), visited) + estimateSize(reflect.ValueOf(value), visited)
+}
+
+func estimateSize(v reflect.Value, visited map[uintptr]bool) int64 {
+	if !v.IsValid() {
+		return 0
+	}
+
+	size := int64(v.Type().Size())
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() || visited[v.Pointer()] {
+			return size
+		}
+		visited[v.Pointer()] = true
+		size += estimateSize(v.Elem(), visited)
+	case reflect.Interface:
+		size += estimateSize(v.Elem(), visited)
+	case reflect.String:
+		size += int64(v.Len())
+	case reflect.Slice:
+		if v.IsNil() || visited[v.Pointer()] {
+			return size
+		}
+		visited[v.Pointer()] = true
+		for i := 0; i < v.Len(); i++ {
+			size += estimateSize(v.Index(i), visited)
+		}
+	case reflect.Array:
+		size = 0
+		for i := 0; i < v.Len(); i++ {
+			size += estimateSize(v.Index(i), visited)
+		}
+	case reflect.Map:
+		if v.IsNil() || visited[v.Pointer()] {
+			return size
+		}
+		visited[v.Pointer()] = true
+		for _, key := range v.MapKeys() {
+			size += estimateSize(key, visited) + estimateSize(v.MapIndex(key), visited)
+		}
+	case reflect.Struct:
+		size = 0
+		for i := 0; i < v.NumField(); i++ {
+			size += estimateSize(v.Field(i), visited)
+		}
+	}
+	return size
+}
@@ -0,0 +1,159 @@
+package portal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRUCache_MaxEntries(t *testing.T) {
+	ctx := context.TODO()
+
+	var evictedKeys []interface{}
+	c := NewLRUCache(2, 0, LRUShards(1), LRUOnEvict(func(key, value interface{}) {
+		evictedKeys = append(evictedKeys, key)
+	}))
+
+	assert.Nil(t, c.Set(ctx, "a", 1))
+	assert.Nil(t, c.Set(ctx, "b", 2))
+	_, err := c.Get(ctx, "a")
+	assert.Nil(t, err)
+	assert.Nil(t, c.Set(ctx, "c", 3))
+
+	// b is the least recently used one
+	_, err = c.Get(ctx, "b")
+	assert.IsType(t, &ErrNil{}, err)
+	v, err := c.Get(ctx, "a")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, v)
+	v, err = c.Get(ctx, "c")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, v)
+
+	assert.Equal(t, []interface{}{"b"}, evictedKeys)
+	assert.Equal(t, 2, c.Len())
+
+	stats := c.Stats()
+	assert.Equal(t, 2, stats.Entries)
+	assert.Equal(t, uint64(3), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.Equal(t, uint64(1), stats.Evictions)
+}
+
+func TestLRUCache_MaxBytes(t *testing.T) {
+	ctx := context.TODO()
+	sizeOf := func(key, value interface{}) int64 {
+		return int64(len(value.(string)))
+	}
+	c := NewLRUCache(0, 10, LRUShards(1), LRUSizeFunc(sizeOf))
+
+	assert.Nil(t, c.Set(ctx, "a", "12345"))
+	assert.Nil(t, c.Set(ctx, "b", "12345"))
+	assert.Equal(t, int64(10), c.Stats().Bytes)
+
+	assert.Nil(t, c.Set(ctx, "c", "1"))
+	assert.Equal(t, 2, c.Len())
+	assert.Equal(t, int64(6), c.Stats().Bytes)
+	_, err := c.Get(ctx, "a")
+	assert.IsType(t, &ErrNil{}, err)
+
+	// replace an existing entry
+	assert.Nil(t, c.Set(ctx, "c", "123"))
+	assert.Equal(t, int64(8), c.Stats().Bytes)
+
+	// an entry larger than the limit is kept alone
+	assert.Nil(t, c.Set(ctx, "d", "0123456789abc"))
+	assert.Equal(t, 1, c.Len())
+	v, err := c.Get(ctx, "d")
+	assert.Nil(t, err)
+	assert.Equal(t, "0123456789abc", v)
+}
+
+func TestLRUCache_TTL(t *testing.T) {
+	ctx := context.TODO()
+	evicted := 0
+	c := NewLRUCache(10, 0, LRUOnEvict(func(key, value interface{}) {
+		evicted++
+	}))
+
+	assert.Nil(t, c.SetWithTTL(ctx, "a", 1, 10*time.Millisecond))
+	assert.Nil(t, c.Set(ctx, "b", 2))
+	time.Sleep(20 * time.Millisecond)
+
+	_, err := c.Get(ctx, "a")
+	assert.IsType(t, &ErrNil{}, err)
+	_, err = c.Get(ctx, "b")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, evicted)
+	assert.Equal(t, 1, c.Len())
+}
+
+func TestLRUCache_Concurrency(t *testing.T) {
+	ctx := context.TODO()
+	c := NewLRUCache(100, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				key := fmt.Sprintf("%d-%d", i, j%200)
+				_ = c.Set(ctx, key, j)
+				_, _ = c.Get(ctx, key)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	stats := c.Stats()
+	assert.True(t, stats.Entries <= 100+defaultLRUShards, "entries: %d", stats.Entries)
+	assert.True(t, stats.Evictions > 0)
+}
+
+func TestLRUCache_Shards(t *testing.T) {
+	assert.Len(t, NewLRUCache(0, 0).shards, defaultLRUShards)
+	assert.Len(t, NewLRUCache(4, 0).shards, 4)
+	assert.Len(t, NewLRUCache(4, 0, LRUShards(0)).shards, 1)
+}
+
+func TestEstimateEntrySize(t *testing.T) {
+	type inner struct {
+		Name string
+	}
+	type outer struct {
+		ID    int64
+		Inner *inner
+		Tags  []string
+	}
+
+	v := &outer{ID: 1, Inner: &inner{Name: "abcd"}, Tags: []string{"x", "yz"}}
+	size := estimateEntrySize("key", v)
+	assert.True(t, size > int64(len("key")+len("abcd")+len("x")+len("yz")))
+
+	// cycles are counted only once
+	type node struct {
+		Next *node
+	}
+	n := &node{}
+	n.Next = n
+	assert.True(t, estimateEntrySize(1, n) > 0)
+
+	m := map[string]string{"ab": "cdef"}
+	assert.True(t, estimateEntrySize(1, m) >= int64(len("ab")+len("cdef")))
+}
+
+func TestLRUCache_NoBytesWithoutLimit(t *testing.T) {
+	ctx := context.TODO()
+	c := NewLRUCache(10, 0)
+	assert.Nil(t, c.Set(ctx, "a", "12345"))
+	assert.Equal(t, int64(0), c.Stats().Bytes)
+
+	c = NewLRUCache(10, 1<<20)
+	assert.Nil(t, c.Set(ctx, "a", "12345"))
+	assert.True(t, c.Stats().Bytes > 0)
+}
@@ -1,6 +1,11 @@
 package portal
 
-import "github.com/pkg/errors"
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
 
 type option func(c *Chell) error
 
@@ -17,6 +22,7 @@ func Only(fields ...string) option {
 			return errors.WithStack(err)
 		}
 		c.onlyFieldFilters = filters
+		c.onlyNone = false
 		return nil
 	}
 }
@@ -38,6 +44,55 @@ func Exclude(fields ...string) option {
 	}
 }
 
+// OnlyFilter specifies the fields to keep with a parsed filter.
+// `Only` keeps taking strings so that `Only(fields...)` with a `[]string`
+// still compiles, use `OnlyFilter` for a `*Filter`.
+// A filter selecting nothing, e.g. an empty intersection, keeps no fields.
+// Example:
+// ```
+// f, _ := ParseFilter("A[B,C]")
+// c := New(OnlyFilter(f.Merge(defaultFilter)))
+// ```
+func OnlyFilter(f *Filter) option {
+	return func(c *Chell) error {
+		c.onlyFieldFilters = f.levels()
+		c.onlyNone = f.selectsNone()
+		return nil
+	}
+}
+
+// ExcludeFilter specifies the fields to exclude with a parsed filter,
+// the `*Filter` counterpart of `Exclude`.
+func ExcludeFilter(f *Filter) option {
+	return func(c *Chell) error {
+		c.excludeFieldFilters = f.levels()
+		return nil
+	}
+}
+
+// FilterCombineMode decides how the runtime filters (`Only`, `Exclude`)
+// work with the `only` and `exclude` tag settings of nested fields.
+type FilterCombineMode int
+
+const (
+	// FilterOverrideTag uses the runtime filter and ignores the tag settings
+	// if both are present. It's the default mode.
+	FilterOverrideTag FilterCombineMode = iota
+	// FilterMergeTag uses the union of the runtime filter and the tag settings.
+	FilterMergeTag
+	// FilterIntersectTag uses the intersection of the runtime filter and the tag settings.
+	FilterIntersectTag
+)
+
+// CombineTagFilter sets how runtime filters are combined with the `only`
+// and `exclude` tag settings. If only one of them is present, it's used as is.
+func CombineTagFilter(mode FilterCombineMode) option {
+	return func(c *Chell) error {
+		c.filterCombineMode = mode
+		return nil
+	}
+}
+
 // FieldAliasMapTagName sets the tag name (e.g. `yaml`, `json`) to parse alias of a field name.
 // Example:
 // ```
@@ -79,3 +134,124 @@ func DisableCache() option {
 		return nil
 	}
 }
+
+// WithWorkerPool sets the worker pool processing async fields and many
+// objects, instead of the global pool.
+// Example:
+// ```
+// pool, _ := portal.NewPool(100)
+// portal.Dump(&dst, &src, portal.WithWorkerPool(pool))
+// ```
+func WithWorkerPool(p *Pool) option {
+	return func(c *Chell) error {
+		if p != nil {
+			c.exec = p
+		}
+		return nil
+	}
+}
+
+// WithExecutor sets the executor running async fields and many objects,
+// instead of the global pool. It's the general form of `WithWorkerPool`.
+// Example:
+// ```
+// portal.Dump(&dst, &src, portal.WithExecutor(portal.NewGoroutineExecutor(100)))
+// // deterministic dumps in tests
+// portal.Dump(&dst, &src, portal.WithExecutor(portal.SyncExecutor))
+// ```
+func WithExecutor(e Executor) option {
+	return func(c *Chell) error {
+		c.exec = e
+		return nil
+	}
+}
+
+// MaxConcurrency limits how many field and element jobs of a dump, including all
+// nested levels, run at once, independent of the worker pool size. Jobs exceeding
+// the limit run inline, n = 1 makes the dump run sequentially.
+// Example:
+// ```
+// portal.Dump(&dst, &src, portal.MaxConcurrency(8))
+// ```
+func MaxConcurrency(n int) option {
+	return func(c *Chell) error {
+		c.maxConcurrency = n
+		return nil
+	}
+}
+
+// ParallelElements dumps elements of lists in parallel chunks of chunkSize
+// elements, even if the schema has no async fields. Larger chunks amortize
+// the scheduling overhead for cheap elements.
+// Example:
+// ```
+// portal.Dump(&dst, &src, portal.ParallelElements(64))
+// ```
+func ParallelElements(chunkSize int) option {
+	return func(c *Chell) error {
+		if chunkSize <= 0 {
+			return errors.Errorf("invalid chunk size %d, it must be positive", chunkSize)
+		}
+		c.parallelChunkSize = chunkSize
+		return nil
+	}
+}
+
+// WithPanicPolicy sets how panics of schema methods are handled, panics are
+// returned as *PanicError by default, whether fields are async or not.
+// Example:
+// ```
+// portal.Dump(&dst, &src, portal.WithPanicPolicy(portal.PanicRepanic))
+// ```
+func WithPanicPolicy(policy PanicPolicy) option {
+	return func(c *Chell) error {
+		c.panicPolicy = policy
+		return nil
+	}
+}
+
+// ShedOptionalFields skips async fields tagged with `optional` when the worker pool
+// is full, or their jobs wait longer than maxWait to start (0 means no limit).
+// Shed fields are left at their `default` values, and their paths are appended
+// to shed if it's not nil. Use `WithShedReport` to get the fields shed by each
+// dump of a Chell shared by goroutines.
+// Example:
+// ```
+// var shed []string
+// portal.Dump(&dst, &src, portal.ShedOptionalFields(50*time.Millisecond, &shed))
+// ```
+func ShedOptionalFields(maxWait time.Duration, shed *[]string) option {
+	return func(c *Chell) error {
+		c.shedding = true
+		c.shedMaxWait = maxWait
+		c.shedReport = shed
+		return nil
+	}
+}
+
+// UseCache sets the Cacher of the dump instead of the one set by `SetCache`,
+// it takes effect even if the global cache is disabled.
+// Example:
+// ```
+// portal.Dump(&dst, &src, portal.UseCache(redisCache))
+// ```
+func UseCache(cache Cacher) option {
+	return func(c *Chell) error {
+		c.cache = cache
+		return nil
+	}
+}
+
+// CacheVaryFunc sets a function whose result is folded into all cache keys
+// of the dump, so cached values of different viewers (e.g. user, locale)
+// never mix up.
+// Example:
+// ```
+// portal.Dump(&dst, &src, portal.CacheVaryFunc(viewerIDFromContext))
+// ```
+func CacheVaryFunc(fn func(ctx context.Context) string) option {
+	return func(c *Chell) error {
+		c.cacheVaryFunc = fn
+		return nil
+	}
+}
@@ -0,0 +1,81 @@
+package portal
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/pkg/errors"
+)
+
+// PanicPolicy decides how panics of schema methods and custom types are handled.
+type PanicPolicy int
+
+const (
+	// PanicAsError recovers panics and the dump returns a *PanicError.
+	// It's the default policy.
+	PanicAsError PanicPolicy = iota
+	// PanicRepanic recovers panics and panics again with the *PanicError on the
+	// goroutine calling Dump, even if the panic happened in a worker.
+	PanicRepanic
+)
+
+// PanicError is returned when a method panics during the dump.
+type PanicError struct {
+	// Value is the recovered value.
+	Value interface{}
+	// Field is the path of the field from the root schema, e.g. `UserSchema.Profile.Avatar`.
+	// It's empty if the panic happened outside of fields.
+	Field string
+	// Stack is the stack trace of the panicking goroutine.
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("panic: %v", e.Value)
+	}
+	return fmt.Sprintf("panic in field '%s': %v", e.Field, e.Value)
+}
+
+var fieldPathCtxKey = contextKey{name: "field-path"}
+
+// withFieldPath sets the path of the nested field being dumped.
+func withFieldPath(ctx context.Context, field *schemaField) context.Context {
+	return context.WithValue(ctx, fieldPathCtxKey, fieldPath(ctx, field))
+}
+
+// fieldPath returns the path of field from the root schema.
+func fieldPath(ctx context.Context, field *schemaField) string {
+	if path, _ := ctx.Value(fieldPathCtxKey).(string); path != "" {
+		return path + "." + field.Name()
+	}
+	return field.String()
+}
+
+// recoverFieldPanic turns the panic of dumping field into a *PanicError,
+// it must be called by defer. A *PanicError recovered without the field
+// (e.g. by a cached call shared with other dumps) is returned with it.
+func recoverFieldPanic(ctx context.Context, field *schemaField, err *error) {
+	if p := recover(); p != nil {
+		e := &PanicError{Value: p, Field: fieldPath(ctx, field), Stack: debug.Stack()}
+		logger.Errorf("[portal.panic] %s\n%s\n", e, e.Stack)
+		*err = e
+		return
+	}
+
+	if e, ok := errors.Cause(*err).(*PanicError); ok && e.Field == "" {
+		// the error may be shared, never modify it.
+		*err = &PanicError{Value: e.Value, Field: fieldPath(ctx, field), Stack: e.Stack}
+	}
+}
+
+// recoverPanic turns the panic into a *PanicError without the field,
+// it must be called by defer.
+func recoverPanic(err *error) {
+	if p := recover(); p != nil {
+		e := &PanicError{Value: p, Stack: debug.Stack()}
+		logger.Errorf("[portal.panic] %s\n%s\n", e, e.Stack)
+		*err = e
+	}
+}
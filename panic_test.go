@@ -0,0 +1,135 @@
+package portal
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type PanicChildSchema struct {
+	Name string `portal:"meth:GetName"`
+}
+
+func (s *PanicChildSchema) GetName(m *Student) string {
+	if m.ID < 0 {
+		panic("negative id")
+	}
+	return m.FirstName
+}
+
+type PanicSchema struct {
+	Name      string            `portal:"meth:GetName"`
+	AsyncName string            `portal:"meth:GetName;async"`
+	Child     *PanicChildSchema `portal:"nested;meth:GetChild;async"`
+}
+
+func (s *PanicSchema) GetName(m *Student) string {
+	if m.ID == 0 {
+		panic("zero id")
+	}
+	return m.FirstName
+}
+
+func (s *PanicSchema) GetChild(m *Student) *Student {
+	return &Student{ID: -m.ID, FirstName: m.FirstName}
+}
+
+// panicErrorOf returns the *PanicError causing err, it fails the test if not found.
+func panicErrorOf(t *testing.T, err error) *PanicError {
+	panicErr, ok := errors.Cause(err).(*PanicError)
+	require.True(t, ok, "%v is not caused by a panic", err)
+	return panicErr
+}
+
+func TestDump_PanicAsError(t *testing.T) {
+	// sync and async fields behave the same
+	var dst PanicSchema
+	err := Dump(&dst, &Student{ID: 0}, Only("Name"))
+	panicErr := panicErrorOf(t, err)
+	assert.Equal(t, "zero id", panicErr.Value)
+	assert.Equal(t, "PanicSchema.Name", panicErr.Field)
+	assert.NotEmpty(t, panicErr.Stack)
+
+	err = Dump(&dst, &Student{ID: 0}, Only("AsyncName"))
+	panicErr = panicErrorOf(t, err)
+	assert.Equal(t, "PanicSchema.AsyncName", panicErr.Field)
+
+	err = Dump(&dst, &Student{ID: 1}, Only("Child"))
+	panicErr = panicErrorOf(t, err)
+	assert.Equal(t, "negative id", panicErr.Value)
+	assert.Equal(t, "PanicSchema.Child.Name", panicErr.Field)
+	assert.Equal(t, "panic in field 'PanicSchema.Child.Name': negative id", panicErr.Error())
+
+	var many []*PanicSchema
+	err = Dump(&many, []*Student{{ID: 1}, {ID: 0}}, Only("Name"), DisableConcurrency())
+	panicErr = panicErrorOf(t, err)
+	assert.Equal(t, "PanicSchema.Name", panicErr.Field)
+}
+
+func TestDump_PanicRepanic(t *testing.T) {
+	var dst PanicSchema
+	cases := []struct {
+		only  string
+		id    int
+		field string
+	}{
+		{"Name", 0, "PanicSchema.Name"},
+		{"AsyncName", 0, "PanicSchema.AsyncName"},
+		{"Child", 1, "PanicSchema.Child.Name"},
+	}
+	for _, c := range cases {
+		func() {
+			defer func() {
+				panicErr, ok := recover().(*PanicError)
+				assert.True(t, ok)
+				assert.Equal(t, c.field, panicErr.Field)
+			}()
+			_ = Dump(&dst, &Student{ID: c.id}, Only(c.only), WithPanicPolicy(PanicRepanic))
+		}()
+	}
+
+	assert.Nil(t, Dump(&dst, &Student{ID: 0, FirstName: "Harry"}, Only("Child"), WithPanicPolicy(PanicRepanic)))
+	assert.Equal(t, "Harry", dst.Child.Name)
+}
+
+type PanicCachedSchema struct {
+	Name string `portal:"meth:GetName;cacheerr:1m"`
+}
+
+var panicCachedCalls int32
+
+func (s *PanicCachedSchema) GetName(m *IdentifiedModel) string {
+	atomic.AddInt32(&panicCachedCalls, 1)
+	panic("cached panic")
+}
+
+func TestDump_PanicWithRequestCache(t *testing.T) {
+	ctx, release := WithRequestCache(context.TODO())
+	defer release()
+
+	atomic.StoreInt32(&panicCachedCalls, 0)
+	for i := 0; i < 2; i++ {
+		done := make(chan error, 1)
+		go func() {
+			var dst PanicCachedSchema
+			done <- DumpWithContext(ctx, &dst, &IdentifiedModel{ID: 1})
+		}()
+
+		select {
+		case err := <-done:
+			var panicErr *PanicError
+			panicErr = panicErrorOf(t, err)
+			assert.Equal(t, "cached panic", panicErr.Value)
+			assert.Equal(t, "PanicCachedSchema.Name", panicErr.Field)
+		case <-time.After(time.Second):
+			t.Fatal("dump with the same cache key hangs after a panic")
+		}
+	}
+	// panics are never cached
+	assert.Equal(t, int32(2), atomic.LoadInt32(&panicCachedCalls))
+}
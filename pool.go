@@ -2,9 +2,10 @@ package portal
 
 import (
 	"context"
-	"fmt"
-	"runtime"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/panjf2000/ants/v2"
 	"github.com/pkg/errors"
@@ -17,75 +18,275 @@ var (
 	// consuming too many resources.
 	maxWorkerPoolSize = 10 * 1000
 
-	// levelWorkerPoolMap are global goroutine pools which are
-	// responsible for processing schema fields asynchronously.
-	// Note that each dumping level gets a worker pool to avoid
-	// dead lock.
-	levelWorkerPoolMap sync.Map
+	// defaultPool is the global goroutine pool which is responsible for
+	// processing schema fields asynchronously, unless a Chell owns its pool
+	// by option `WithWorkerPool`.
+	defaultPool *Pool
 )
 
 var (
 	errFailedToInitWorkerPool = errors.New("failed to init portal worker pool")
+	// ErrPoolClosed is returned when dumping with a closed worker pool.
+	ErrPoolClosed = errors.New("portal worker pool is closed")
 )
 
 type (
 	// processFunc is a callback function to be called in a worker.
 	// It accepts user defined payload and returns user expected result.
-	processFunc func(payload interface{}) (interface{}, error)
+	// The ctx is cancelled once any job of the same submission fails.
+	processFunc func(ctx context.Context, payload interface{}) (interface{}, error)
 	jobRequest  struct {
 		ctx        context.Context
 		wg         *sync.WaitGroup
 		payload    interface{}
 		pf         processFunc
 		resultChan chan *jobResult
+		// cancel cancels the siblings of the job once it fails.
+		cancel   context.CancelFunc
+		recorder jobRecorder
+		// release is called when the job is done, if it holds a concurrency slot.
+		release func()
+		// busy is true if the executor is busy, submittedAt is set if
+		// optional jobs can be shed.
+		busy        bool
+		submittedAt time.Time
 	}
 
 	// jobResult contains the result data and an optional error.
+	// Data is the payload if the job is shed.
 	jobResult struct {
 		Data interface{}
 		Err  error
+		Shed bool
 	}
 )
 
-// submitJobs submits jobs to the worker pool and return the collected results.
-func submitJobs(ctx context.Context, pf processFunc, payloads ...interface{}) (<-chan *jobResult, error) {
-	logger.Debugf("[portal.pool] submit jobs with %d payloads", len(payloads))
-	var wg sync.WaitGroup
+// Pool is a goroutine pool processing schema fields asynchronously.
+// A single bounded pool serves all dumping levels: when all workers are busy,
+// jobs run inline in the submitting goroutine, so nested async work never waits
+// for workers held by its parents, which avoids dead lock.
+type Pool struct {
+	mu     sync.Mutex
+	wp     *ants.Pool
+	closed bool
 
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+	submitted uint64
+	inline    uint64
+	completed uint64
+	failed    uint64
+	shed      uint64
+}
 
-	level := dumpDepthFromContext(ctx)
+// PoolStats contains the statistics of a worker pool.
+type PoolStats struct {
+	// Size is the max number of workers.
+	Size int `json:"size"`
+	// Running is the number of running workers.
+	Running int `json:"running"`
+	// Submitted, Completed and Failed count jobs, failed jobs
+	// returned errors or panicked.
+	Submitted uint64 `json:"submitted"`
+	Completed uint64 `json:"completed"`
+	Failed    uint64 `json:"failed"`
+	// Inline counts jobs run in the submitting goroutine because all workers were busy.
+	Inline uint64 `json:"inline"`
+	// Shed counts completed jobs of optional fields skipped under pressure.
+	Shed uint64 `json:"shed"`
+}
 
-	var workerPool *ants.PoolWithFunc
-	pool, ok := levelWorkerPoolMap.Load(level)
-	if ok {
-		workerPool = pool.(*ants.PoolWithFunc)
-	} else {
-		logger.Debugf("[portal.pool] worker pool with level %d not found, try to create a new one", level)
-		pool, err := ants.NewPoolWithFunc(1, processRequest)
-		if err != nil {
-			return nil, errors.WithStack(err)
+// NewPool creates a worker pool with at most size workers.
+// Use it with option `WithWorkerPool` to isolate dumps of a Chell (or tenant)
+// from others, call Close when it's no longer used.
+// Example:
+// ```
+// pool, _ := portal.NewPool(100)
+// defer pool.Close()
+//
+// chell, _ := portal.New(portal.WithWorkerPool(pool))
+// ```
+func NewPool(size int) (*Pool, error) {
+	if size <= 0 {
+		size = 1
+	}
+
+	wp, err := ants.NewPool(size, ants.WithNonblocking(true))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &Pool{wp: wp}, nil
+}
+
+// Tune changes the max number of workers.
+func (p *Pool) Tune(size int) {
+	if size <= 0 {
+		size = 1
+	}
+	logger.Debugf("[portal.pool] tune pool capacity to %d", size)
+	p.wp.Tune(size)
+}
+
+// Close releases the workers, dumps with the pool fail with ErrPoolClosed after.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return
+	}
+	p.closed = true
+	p.wp.Release()
+}
+
+// Submit runs task in a worker, it returns ErrExecutorBusy if all workers are busy.
+func (p *Pool) Submit(task func()) error {
+	if p.isClosed() {
+		return errors.WithStack(ErrPoolClosed)
+	}
+
+	switch err := p.wp.Submit(task); err {
+	case nil:
+		return nil
+	case ants.ErrPoolOverload:
+		return errors.WithStack(ErrExecutorBusy)
+	case ants.ErrPoolClosed:
+		return errors.WithStack(ErrPoolClosed)
+	default:
+		return errors.WithStack(err)
+	}
+}
+
+// Shutdown stops accepting jobs and waits for the running jobs until ctx is done,
+// then releases the workers. It returns the number of jobs still running when ctx
+// is done, along with ctx.Err(). Dumps with the pool fail with ErrPoolClosed after.
+func (p *Pool) Shutdown(ctx context.Context) (abandoned int, err error) {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for p.runningJobs() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			abandoned = p.runningJobs()
+			p.wp.Release()
+			return abandoned, errors.WithStack(ctx.Err())
 		}
+	}
+	p.wp.Release()
+	return 0, nil
+}
+
+// runningJobs returns the number of submitted jobs not completed yet.
+func (p *Pool) runningJobs() int {
+	return int(atomic.LoadUint64(&p.submitted) - atomic.LoadUint64(&p.completed))
+}
+
+func (p *Pool) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+func (p *Pool) jobSubmitted() {
+	atomic.AddUint64(&p.submitted, 1)
+}
+
+func (p *Pool) jobInline() {
+	atomic.AddUint64(&p.inline, 1)
+}
+
+func (p *Pool) jobShed() {
+	atomic.AddUint64(&p.shed, 1)
+	atomic.AddUint64(&p.completed, 1)
+}
+
+func (p *Pool) jobDone(err error) {
+	if err != nil {
+		atomic.AddUint64(&p.failed, 1)
+	}
+	atomic.AddUint64(&p.completed, 1)
+}
 
-		levelWorkerPoolMap.Store(level, pool)
-		workerPool = pool
-		SetMaxPoolSize(maxWorkerPoolSize)
+// Stats returns the statistics of the pool.
+func (p *Pool) Stats() PoolStats {
+	return PoolStats{
+		Size:      p.wp.Cap(),
+		Running:   p.wp.Running(),
+		Submitted: atomic.LoadUint64(&p.submitted),
+		Completed: atomic.LoadUint64(&p.completed),
+		Failed:    atomic.LoadUint64(&p.failed),
+		Inline:    atomic.LoadUint64(&p.inline),
+		Shed:      atomic.LoadUint64(&p.shed),
 	}
+}
+
+// submitJobs submits jobs to the default worker pool and return the collected results.
+func submitJobs(ctx context.Context, pf processFunc, payloads ...interface{}) (<-chan *jobResult, error) {
+	return submitJobsTo(ctx, defaultPool, pf, payloads...)
+}
 
+// submitJobsTo submits jobs to the executor and return the collected results.
+// Jobs run inline in the submitting goroutine if the executor is busy
+// or the dump reaches its concurrency limit.
+func submitJobsTo(ctx context.Context, executor Executor, pf processFunc, payloads ...interface{}) (<-chan *jobResult, error) {
+	logger.Debugf("[portal.pool] submit jobs with %d payloads", len(payloads))
+	var wg sync.WaitGroup
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	recorder, _ := executor.(jobRecorder)
+	limiter := concurrencyLimiterFromContext(ctx)
+	shedding := shedPolicyFromContext(ctx) != nil
 	resultChan := make(chan *jobResult, len(payloads))
 	for _, payload := range payloads {
 		wg.Add(1)
-		err := workerPool.Invoke(&jobRequest{
+		req := &jobRequest{
 			ctx:        ctx,
 			wg:         &wg,
 			payload:    payload,
 			pf:         pf,
 			resultChan: resultChan,
-		})
-		if err != nil {
+			cancel:     cancel,
+			recorder:   recorder,
+		}
+		if shedding {
+			req.submittedAt = time.Now()
+		}
+
+		if recorder != nil {
+			recorder.jobSubmitted()
+		}
+
+		if !limiter.tryAcquire() {
+			// the dump reaches its concurrency limit.
+			req.runInline()
+			continue
+		}
+		req.release = limiter.release
+
+		err := executor.Submit(func() { processRequest(req) })
+		switch errors.Cause(err) {
+		case nil:
+		case ErrExecutorBusy:
+			// all workers are busy, maybe with the parents of the job.
+			limiter.release()
+			req.release = nil
+			req.busy = true
+			req.runInline()
+		default:
+			limiter.release()
+			if recorder != nil {
+				recorder.jobDone(err)
+			}
+			wg.Done()
 			cancel()
-			return nil, errors.WithStack(errFailedToInitWorkerPool)
+			if errors.Cause(err) == ErrPoolClosed {
+				return nil, errors.WithStack(ErrPoolClosed)
+			}
+			return nil, errors.Wrap(err, errFailedToInitWorkerPool.Error())
 		}
 	}
 
@@ -96,10 +297,6 @@ func submitJobs(ctx context.Context, pf processFunc, payloads ...interface{}) (<
 
 	results := make(chan *jobResult, len(payloads))
 	for result := range resultChan {
-		if result.Err != nil {
-			cancel()
-		}
-
 		results <- result
 	}
 	close(results)
@@ -110,88 +307,124 @@ func submitJobs(ctx context.Context, pf processFunc, payloads ...interface{}) (<
 // SetMaxPoolSize limits the capacity of all worker pools.
 func SetMaxPoolSize(size int) {
 	logger.Debugf("[portal.pool] set max worker pool size to %d", size)
-	if size == 0 {
-		maxWorkerPoolSize = 1
-	}
-
 	maxWorkerPoolSize = size
-
-	var length int
-	levelWorkerPoolMap.Range(func(key, value interface{}) bool {
-		length++
-		return true
-	})
-
-	if length == 0 {
-		return
-	}
-
-	// make sure capacity is valid.
-	capacity := size / length
-	if capacity == 0 {
-		capacity = 1
-	}
-
-	levelWorkerPoolMap.Range(func(level, value interface{}) bool {
-		pool, ok := value.(*ants.PoolWithFunc)
-		if ok {
-			logger.Debugf("[portal.pool] tune pool.%d capacity to %d", level.(int), capacity)
-			pool.Tune(capacity)
-		}
-		return true
-	})
+	defaultPool.Tune(size)
 }
 
-// CleanUp releases the global worker pool.
+// CleanUp releases the global worker pool immediately, use `Shutdown`
+// to wait for the running dumps.
 // You should call this function only once before the main goroutine exits.
 func CleanUp() {
-	levelWorkerPoolMap.Range(func(key, value interface{}) bool {
-		pool, ok := value.(*ants.PoolWithFunc)
-		if ok {
-			pool.Release()
-		}
-		return true
-	})
+	defaultPool.Close()
+}
+
+// runInline processes the job in the submitting goroutine.
+func (req *jobRequest) runInline() {
+	if req.recorder != nil && !req.shouldShed() {
+		req.recorder.jobInline()
+	}
+	processRequest(req)
 }
 
 func processRequest(request interface{}) {
 	switch req := request.(type) {
 	case *jobRequest:
 		defer req.wg.Done()
+		if req.release != nil {
+			defer req.release()
+		}
 
-		select {
-		case <-req.ctx.Done():
-		case req.resultChan <- func() *jobResult {
-			data, err := func() (data interface{}, err error) {
-				defer func() {
-					if p := recover(); p != nil {
-						var buf [4096]byte
-						n := runtime.Stack(buf[:], false)
-						err = errors.New(fmt.Sprintf("%s", p))
-						logger.Errorf("[portal.pool] worker crashed: %s\n%s\n", p, buf[:n])
-					}
-				}()
-
-				data, err = req.pf(req.payload)
-				return
+		if req.shouldShed() {
+			if req.recorder != nil {
+				req.recorder.jobShed()
+			}
+			req.resultChan <- &jobResult{Data: req.payload, Shed: true}
+			return
+		}
+
+		data, err := func() (data interface{}, err error) {
+			defer func() {
+				if p := recover(); p != nil {
+					e := &PanicError{Value: p, Stack: debug.Stack()}
+					logger.Errorf("[portal.pool] worker crashed: %s\n%s\n", p, e.Stack)
+					err = e
+				}
 			}()
 
-			return &jobResult{Data: data, Err: err}
-		}():
+			if err = req.ctx.Err(); err != nil {
+				// a sibling failed or the dump is cancelled.
+				return nil, errors.WithStack(err)
+			}
+			data, err = req.pf(req.ctx, req.payload)
+			return
+		}()
+
+		if err != nil {
+			req.cancel()
 		}
+		if req.recorder != nil {
+			req.recorder.jobDone(err)
+		}
+		// never blocks, the channel is buffered for all jobs.
+		req.resultChan <- &jobResult{Data: data, Err: err}
 	default:
 		logger.Warnf("[portal.pool] invalid worker request: '%s'", request)
 	}
 }
 
+var concurrencyLimiterCtxKey = contextKey{name: "concurrency-limiter"}
+
+// concurrencyLimiter limits the number of concurrent jobs of a dump, including all
+// nested levels. The goroutine calling Dump takes a slot, so it limits to n-1 workers.
+// A nil limiter means no limit.
+type concurrencyLimiter struct {
+	sem chan struct{}
+}
+
+func newConcurrencyLimiter(n int) *concurrencyLimiter {
+	if n < 1 {
+		n = 1
+	}
+	return &concurrencyLimiter{sem: make(chan struct{}, n-1)}
+}
+
+func withConcurrencyLimiter(ctx context.Context, l *concurrencyLimiter) context.Context {
+	if l == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, concurrencyLimiterCtxKey, l)
+}
+
+func concurrencyLimiterFromContext(ctx context.Context) *concurrencyLimiter {
+	l, _ := ctx.Value(concurrencyLimiterCtxKey).(*concurrencyLimiter)
+	return l
+}
+
+// tryAcquire takes a slot without blocking, jobs which cannot take
+// a slot run inline in the goroutines submitting them.
+func (l *concurrencyLimiter) tryAcquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *concurrencyLimiter) release() {
+	if l == nil {
+		return
+	}
+	<-l.sem
+}
+
 func init() {
-	p, err := ants.NewPoolWithFunc(
-		maxWorkerPoolSize,
-		processRequest,
-	)
+	p, err := NewPool(maxWorkerPoolSize)
 	if err != nil {
 		panic(errFailedToInitWorkerPool)
 	}
-
-	levelWorkerPoolMap.Store(0, p)
+	defaultPool = p
 }
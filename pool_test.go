@@ -2,7 +2,11 @@ package portal
 
 import (
 	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -12,7 +16,7 @@ import (
 func Test_submitJobsOk(t *testing.T) {
 	ctx := context.TODO()
 
-	resultChan, err := submitJobs(ctx, func(payload interface{}) (i interface{}, e error) {
+	resultChan, err := submitJobs(ctx, func(ctx context.Context, payload interface{}) (i interface{}, e error) {
 		return payload, nil
 	}, 1)
 	assert.Nil(t, err)
@@ -27,7 +31,7 @@ func Test_submitJobsOk(t *testing.T) {
 func Test_submitJobsReturnErr(t *testing.T) {
 	ctx := context.TODO()
 
-	resultChan, err := submitJobs(ctx, func(payload interface{}) (i interface{}, e error) {
+	resultChan, err := submitJobs(ctx, func(ctx context.Context, payload interface{}) (i interface{}, e error) {
 		return nil, errors.New("error happened")
 	}, 1)
 	assert.Nil(t, err)
@@ -42,14 +46,253 @@ func Test_submitJobsReturnErr(t *testing.T) {
 func Test_submitJobsCrashed(t *testing.T) {
 	ctx := context.TODO()
 
-	resultChan, err := submitJobs(ctx, func(payload interface{}) (i interface{}, e error) {
+	resultChan, err := submitJobs(ctx, func(ctx context.Context, payload interface{}) (i interface{}, e error) {
 		panic("job crashed")
 	}, 1)
 	assert.Nil(t, err)
 
 	for result := range resultChan {
 		assert.NotNil(t, result)
-		assert.Equal(t, "job crashed", result.Err.Error())
+		panicErr := panicErrorOf(t, result.Err)
+		assert.Equal(t, "job crashed", panicErr.Value)
+		assert.Equal(t, "panic: job crashed", result.Err.Error())
 		assert.Nil(t, result.Data)
 	}
 }
+
+type AsyncSchema struct {
+	Name  string `portal:"meth:GetName;async"`
+	Title string `portal:"meth:GetTitle;async"`
+}
+
+func (s *AsyncSchema) GetName(m *Student) string {
+	return m.FirstName
+}
+
+func (s *AsyncSchema) GetTitle(m *Student) (string, error) {
+	if m.ID < 0 {
+		return "", errors.New("invalid id")
+	}
+	return m.LastName, nil
+}
+
+func TestPool(t *testing.T) {
+	pool, err := NewPool(10)
+	assert.Nil(t, err)
+	defer pool.Close()
+
+	var dst []*AsyncSchema
+	students := []*Student{{ID: 1, FirstName: "Harry", LastName: "Potter"}, {ID: 2, FirstName: "Ron", LastName: "Weasley"}}
+	assert.Nil(t, Dump(&dst, students, WithWorkerPool(pool)))
+	assert.Equal(t, []*AsyncSchema{{Name: "Harry", Title: "Potter"}, {Name: "Ron", Title: "Weasley"}}, dst)
+
+	stats := pool.Stats()
+	// 2 elements, and 2 fields of each element
+	assert.Equal(t, uint64(6), stats.Submitted)
+	assert.Equal(t, uint64(6), stats.Completed)
+	assert.Equal(t, uint64(0), stats.Failed)
+	assert.Equal(t, 10, stats.Size)
+
+	var one AsyncSchema
+	assert.NotNil(t, Dump(&one, &Student{ID: -1}, WithWorkerPool(pool)))
+	// the sibling may be cancelled before it starts
+	assert.True(t, pool.Stats().Failed >= 1)
+
+	pool.Tune(30)
+	assert.Equal(t, 30, pool.Stats().Size)
+}
+
+func TestPool_Close(t *testing.T) {
+	pool, err := NewPool(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, pool.Stats().Size)
+	pool.Close()
+	pool.Close()
+
+	var dst AsyncSchema
+	err = Dump(&dst, &Student{ID: 1}, WithWorkerPool(pool))
+	assert.Equal(t, ErrPoolClosed, errors.Cause(err))
+	// rejected jobs are done
+	assert.Equal(t, pool.Stats().Submitted, pool.Stats().Completed)
+
+	// the global pool is not affected
+	assert.Nil(t, Dump(&dst, &Student{ID: 1, FirstName: "Harry"}))
+	assert.Equal(t, "Harry", dst.Name)
+}
+
+type TreeModel struct {
+	Depth int
+	Index int
+}
+
+func (m *TreeModel) Children() (children []*TreeModel) {
+	if m.Depth == 0 {
+		return nil
+	}
+	for i := 0; i < 3; i++ {
+		children = append(children, &TreeModel{Depth: m.Depth - 1, Index: i})
+	}
+	return
+}
+
+type TreeSchema struct {
+	Depth    int           `portal:"attr:Depth"`
+	Name     string        `portal:"meth:GetName;async"`
+	Children []*TreeSchema `portal:"nested;attr:Children;async"`
+}
+
+func (s *TreeSchema) GetName(m *TreeModel) string {
+	return fmt.Sprintf("%d-%d", m.Depth, m.Index)
+}
+
+func countTree(nodes []*TreeSchema) (n int) {
+	for _, node := range nodes {
+		n += 1 + countTree(node.Children)
+	}
+	return
+}
+
+func TestPool_DeeplyNestedAsync(t *testing.T) {
+	for _, size := range []int{1, 2, 4, 64} {
+		pool, err := NewPool(size)
+		assert.Nil(t, err)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					var dst []*TreeSchema
+					roots := []*TreeModel{{Depth: 4}, {Depth: 4, Index: 1}}
+					assert.Nil(t, Dump(&dst, roots, WithWorkerPool(pool)))
+					// 2 * (1 + 3 + 9 + 27 + 81)
+					assert.Equal(t, 242, countTree(dst))
+					assert.Equal(t, "0-2", dst[1].Children[2].Children[2].Children[2].Children[2].Name)
+				}()
+			}
+			wg.Wait()
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(30 * time.Second):
+			t.Fatalf("dead lock with pool size %d", size)
+		}
+
+		stats := pool.Stats()
+		assert.Equal(t, stats.Submitted, stats.Completed)
+		if size == 1 {
+			assert.True(t, stats.Inline > 0)
+		}
+		pool.Close()
+	}
+}
+
+type concurrencyTracker struct {
+	running, max int32
+}
+
+func (c *concurrencyTracker) track() {
+	n := atomic.AddInt32(&c.running, 1)
+	for {
+		max := atomic.LoadInt32(&c.max)
+		if n <= max || atomic.CompareAndSwapInt32(&c.max, max, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	atomic.AddInt32(&c.running, -1)
+}
+
+type trackedModel struct {
+	tracker *concurrencyTracker
+}
+
+func (m *trackedModel) Children() []*trackedModel {
+	m.tracker.track()
+	return []*trackedModel{{m.tracker}, {m.tracker}}
+}
+
+type TrackedChildSchema struct {
+	A string `portal:"meth:GetA;async"`
+	B string `portal:"meth:GetB;async"`
+}
+
+func (s *TrackedChildSchema) GetA(m *trackedModel) string {
+	m.tracker.track()
+	return "a"
+}
+
+func (s *TrackedChildSchema) GetB(m *trackedModel) string {
+	m.tracker.track()
+	return "b"
+}
+
+type TrackedSchema struct {
+	TrackedChildSchema
+	Children []*TrackedChildSchema `portal:"nested;attr:Children;async"`
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	dump := func(opts ...option) int32 {
+		tracker := &concurrencyTracker{}
+		models := make([]*trackedModel, 20)
+		for i := range models {
+			models[i] = &trackedModel{tracker}
+		}
+
+		var dst []*TrackedSchema
+		assert.Nil(t, Dump(&dst, models, append(opts, DisableCache())...))
+		assert.Len(t, dst, 20)
+		assert.Equal(t, "b", dst[19].Children[1].B)
+		return atomic.LoadInt32(&tracker.max)
+	}
+
+	assert.True(t, dump() > 3)
+	assert.True(t, dump(MaxConcurrency(3)) <= 3)
+	assert.Equal(t, int32(1), dump(MaxConcurrency(1)))
+}
+
+type IndexedModel struct {
+	Index   int
+	tracker *concurrencyTracker
+}
+
+func (m *IndexedModel) Value() int {
+	m.tracker.track()
+	return m.Index
+}
+
+type IndexedSchema struct {
+	Value int `portal:"attr:Value"`
+}
+
+func TestParallelElements(t *testing.T) {
+	dump := func(opts ...option) int32 {
+		tracker := &concurrencyTracker{}
+		models := make([]*IndexedModel, 100)
+		for i := range models {
+			models[i] = &IndexedModel{Index: i, tracker: tracker}
+		}
+
+		var dst []IndexedSchema
+		assert.Nil(t, Dump(&dst, models, append(opts, DisableCache())...))
+		assert.Len(t, dst, 100)
+		for i, s := range dst {
+			assert.Equal(t, i, s.Value)
+		}
+		return atomic.LoadInt32(&tracker.max)
+	}
+
+	// no async fields, elements are dumped one by one.
+	assert.Equal(t, int32(1), dump())
+	assert.True(t, dump(ParallelElements(7)) > 1)
+	assert.True(t, dump(ParallelElements(1), MaxConcurrency(2)) <= 2)
+	assert.Equal(t, int32(1), dump(ParallelElements(7), DisableConcurrency()))
+
+	_, err := New(ParallelElements(0))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,82 @@
+package portal
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+var requestCacheCtxKey = contextKey{name: "request-cache"}
+
+type requestCache struct {
+	cache    *MapCache
+	group    *cacheGroup
+	released int32
+	done     chan struct{}
+}
+
+// WithRequestCache returns a copy of ctx carrying a cache shared by every dump
+// performed with the returned context, so results of `attr` and `meth` fields
+// are computed once per request. Concurrent dumps computing the same value are
+// deduplicated.
+// The cache is released when release is called or ctx is done, later dumps with
+// the context use the default per-dump cache.
+// Example:
+// ```
+// ctx, release := portal.WithRequestCache(r.Context())
+// defer release()
+//
+// portal.DumpWithContext(ctx, &taskSchema, task)
+// portal.DumpWithContext(ctx, &commentSchemas, comments)
+// ```
+func WithRequestCache(ctx context.Context) (context.Context, func()) {
+	cache := newMapCache()
+	rc := &requestCache{
+		cache: cache,
+		group: newCacheGroup(cache),
+		done:  make(chan struct{}),
+	}
+	rc.group.requestScoped = true
+
+	var once sync.Once
+	release := func() {
+		once.Do(rc.release)
+	}
+
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				release()
+			case <-rc.done:
+			}
+		}()
+	}
+
+	return context.WithValue(ctx, requestCacheCtxKey, rc), release
+}
+
+func (rc *requestCache) release() {
+	atomic.StoreInt32(&rc.released, 1)
+	close(rc.done)
+
+	// dumps in flight may still use the cache, just drop the entries.
+	rc.cache.c.Range(func(key, _ interface{}) bool {
+		rc.cache.c.Delete(key)
+		return true
+	})
+}
+
+// requestCacheGroupFromContext returns the cache group attached by
+// WithRequestCache, or nil if not found or released.
+func requestCacheGroupFromContext(ctx context.Context) *cacheGroup {
+	rc, ok := ctx.Value(requestCacheCtxKey).(*requestCache)
+	if !ok {
+		return nil
+	}
+
+	if atomic.LoadInt32(&rc.released) == 1 {
+		return nil
+	}
+	return rc.group
+}
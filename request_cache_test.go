@@ -0,0 +1,161 @@
+package portal
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	authorNameCounter int32
+	articleTagCounter int32
+)
+
+type AuthorModel struct {
+	ID int
+}
+
+func (a *AuthorModel) Name() string {
+	atomic.AddInt32(&authorNameCounter, 1)
+	time.Sleep(10 * time.Millisecond)
+	return "author"
+}
+
+type ArticleModel struct {
+	ID     int
+	Author *AuthorModel
+}
+
+type AuthorSchema struct {
+	Name string `json:"name" portal:"attr:Name"`
+}
+
+type ArticleSchema struct {
+	ID     int           `json:"id"`
+	Author *AuthorSchema `json:"author" portal:"nested;async"`
+	Tag    string        `json:"tag" portal:"meth:GetTag;async"`
+}
+
+func (s *ArticleSchema) GetTag(m *ArticleModel) string {
+	atomic.AddInt32(&articleTagCounter, 1)
+	return "tag"
+}
+
+// resetCacheSettings resets the global cache settings as if SetCache was never called.
+func resetCacheSettings() func() {
+	cache, disabled := portalCache, isCacheDisabled
+	portalCache, isCacheDisabled = nil, false
+	return func() {
+		portalCache, isCacheDisabled = cache, disabled
+	}
+}
+
+func TestWithRequestCache(t *testing.T) {
+	defer resetCacheSettings()()
+	atomic.StoreInt32(&authorNameCounter, 0)
+	atomic.StoreInt32(&articleTagCounter, 0)
+
+	author := &AuthorModel{ID: 1}
+	article := &ArticleModel{ID: 1, Author: author}
+	articles := []*ArticleModel{article, {ID: 2, Author: author}}
+
+	ctx, release := WithRequestCache(context.Background())
+
+	var articleSchema ArticleSchema
+	assert.Nil(t, DumpWithContext(ctx, &articleSchema, article))
+	var articleSchemas []*ArticleSchema
+	assert.Nil(t, DumpWithContext(ctx, &articleSchemas, articles))
+	var authorSchema AuthorSchema
+	assert.Nil(t, DumpWithContext(ctx, &authorSchema, author))
+
+	assert.Equal(t, "author", authorSchema.Name)
+	assert.Equal(t, "author", articleSchemas[1].Author.Name)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&authorNameCounter))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&articleTagCounter))
+
+	// released
+	release()
+	release()
+	assert.Nil(t, requestCacheGroupFromContext(ctx))
+	assert.Nil(t, DumpWithContext(ctx, &authorSchema, author))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&authorNameCounter))
+
+	// without request cache
+	assert.Nil(t, Dump(&authorSchema, author))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&authorNameCounter))
+}
+
+func TestWithRequestCache_Concurrent(t *testing.T) {
+	defer resetCacheSettings()()
+	atomic.StoreInt32(&authorNameCounter, 0)
+
+	author := &AuthorModel{ID: 1}
+	ctx, release := WithRequestCache(context.Background())
+	defer release()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var authorSchema AuthorSchema
+			assert.Nil(t, DumpWithContext(ctx, &authorSchema, author))
+			assert.Equal(t, "author", authorSchema.Name)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&authorNameCounter))
+}
+
+func TestWithRequestCache_ReleasedWhenDone(t *testing.T) {
+	parent, cancel := context.WithCancel(context.Background())
+	ctx, release := WithRequestCache(parent)
+	defer release()
+
+	assert.NotNil(t, requestCacheGroupFromContext(ctx))
+	cancel()
+	assert.Eventually(t, func() bool {
+		return requestCacheGroupFromContext(ctx) == nil
+	}, time.Second, time.Millisecond)
+
+	assert.Nil(t, requestCacheGroupFromContext(context.Background()))
+}
+
+func TestWithRequestCache_DisabledCache(t *testing.T) {
+	defer resetCacheSettings()()
+	atomic.StoreInt32(&authorNameCounter, 0)
+	author := &AuthorModel{ID: 1}
+	ctx, release := WithRequestCache(context.Background())
+	defer release()
+
+	var authorSchema AuthorSchema
+	assert.Nil(t, DumpWithContext(ctx, &authorSchema, author, DisableCache()))
+	assert.Nil(t, DumpWithContext(ctx, &authorSchema, author, DisableCache()))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&authorNameCounter))
+
+	SetCache(nil)
+	assert.Nil(t, DumpWithContext(ctx, &authorSchema, author))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&authorNameCounter))
+}
+
+func TestCacheGroup_PinnedValue(t *testing.T) {
+	ctx := context.TODO()
+	cg := newCacheGroup(newMapCache())
+
+	s := &Student{}
+	ck := genCacheKey(ctx, s, s, "FullName", &cacheOption{})
+	assert.Nil(t, cg.set(ctx, ck, "value"))
+
+	raw, err := cg.cache.Get(ctx, ck.key)
+	assert.Nil(t, err)
+	assert.Equal(t, &pinnedValue{obj: s, value: "value"}, raw)
+
+	v, err := cg.get(ctx, ck)
+	assert.Nil(t, err)
+	assert.Equal(t, "value", v)
+}
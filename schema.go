@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
+	"sync"
 
 	"github.com/fatih/structs"
+	"github.com/pkg/errors"
 )
 
 type schema struct {
@@ -17,6 +19,9 @@ type schema struct {
 	fields               []*schemaField
 
 	parent *schema
+	// dependencyOnly are the unselected fields dumped as dependencies of
+	// selected ones, they're cleared after the dump.
+	dependencyOnly []*schemaField
 
 	cacheDisabled bool
 	cacheGroup    *cacheGroup
@@ -94,6 +99,14 @@ func (s *schema) withFieldAliasMapTagName(t string) *schema {
 	return s
 }
 
+// withCacheGroup replaces the default cache group of the schema if cg is not nil.
+func (s *schema) withCacheGroup(cg *cacheGroup) *schema {
+	if cg != nil {
+		s.cacheGroup = cg
+	}
+	return s
+}
+
 func getAvailableFieldNames(fields []*structs.Field) (names []string) {
 	for _, f := range fields {
 		if f.IsEmbedded() {
@@ -140,11 +153,172 @@ func (s *schema) asyncFields(disableConcurrency bool) (fields []*schemaField) {
 	return
 }
 
+// fieldPlan is the dump order of fields of a schema type, computed once by
+// the `after` dependencies of all fields.
+type fieldPlan struct {
+	levels map[string]int
+	err    error
+}
+
+type fieldPlanKey struct {
+	typ reflect.Type
+	// deps joins the dependencies of fields, which may be changed by custom field tags.
+	deps string
+}
+
+var fieldPlans sync.Map
+
+// plan returns the cached field plan of the schema type.
+func (s *schema) plan() *fieldPlan {
+	var sb strings.Builder
+	for _, f := range s.fields {
+		sb.WriteString(f.Name())
+		sb.WriteByte(':')
+		sb.WriteString(strings.Join(f.dependencies(), ","))
+		sb.WriteByte(';')
+	}
+	key := fieldPlanKey{typ: reflect.TypeOf(s.rawValue), deps: sb.String()}
+	if v, ok := fieldPlans.Load(key); ok {
+		return v.(*fieldPlan)
+	}
+
+	p := s.buildPlan()
+	fieldPlans.Store(key, p)
+	return p
+}
+
+// buildPlan levels all fields by their dependencies, fields only depend on
+// fields of lower levels. Cycles are reported whatever fields are selected.
+func (s *schema) buildPlan() *fieldPlan {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	states := make(map[*schemaField]int, len(s.fields))
+	levels := make(map[string]int, len(s.fields))
+	var path []string
+	var visit func(f *schemaField) error
+	visit = func(f *schemaField) error {
+		switch states[f] {
+		case visiting:
+			return fmt.Errorf("cyclic field dependencies in '%s': %s -> %s", s.name(), strings.Join(path, " -> "), f.Name())
+		case visited:
+			return nil
+		}
+
+		states[f] = visiting
+		path = append(path, f.Name())
+		level := 0
+		for _, name := range f.dependencies() {
+			dep := s.fieldByNameOrAlias(name)
+			if dep == nil {
+				return fmt.Errorf("field '%s' depends on unknown field '%s'", f, name)
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+			if levels[dep.Name()]+1 > level {
+				level = levels[dep.Name()] + 1
+			}
+		}
+		path = path[:len(path)-1]
+		states[f] = visited
+		levels[f.Name()] = level
+		return nil
+	}
+
+	for _, f := range s.fields {
+		if err := visit(f); err != nil {
+			return &fieldPlan{err: err}
+		}
+	}
+	return &fieldPlan{levels: levels}
+}
+
+// stages orders the available fields by their `after` dependencies, fields
+// of a stage only depend on fields of the previous stages. Fields keep the
+// struct order in a stage, so schemas without dependencies have one stage.
+// Dependencies of available fields are dumped even if they're not selected,
+// so that the fields never read zero values, call clearDependencyOnlyFields
+// to hide them from the output after the dump.
+func (s *schema) stages() ([][]*schemaField, error) {
+	p := s.plan()
+	if p.err != nil {
+		return nil, p.err
+	}
+	s.includeDependencies()
+
+	var stages [][]*schemaField
+	for _, f := range s.availableFields() {
+		for len(stages) <= p.levels[f.Name()] {
+			stages = append(stages, nil)
+		}
+		stages[p.levels[f.Name()]] = append(stages[p.levels[f.Name()]], f)
+	}
+
+	// levels of unavailable fields leave empty stages.
+	result := stages[:0]
+	for _, fields := range stages {
+		if len(fields) > 0 {
+			result = append(result, fields)
+		}
+	}
+	return result, nil
+}
+
+// includeDependencies makes dependencies of available fields available,
+// and records them as dependency only fields.
+func (s *schema) includeDependencies() {
+	queue := s.availableFields()
+	for len(queue) > 0 {
+		f := queue[0]
+		queue = queue[1:]
+		for _, name := range f.dependencies() {
+			dep := s.fieldByNameOrAlias(name)
+			if dep == nil || s.availableFieldNames[dep.Name()] {
+				continue
+			}
+			logger.Debugf("[portal.schema] field '%s' is dumped as a dependency of '%s'", dep, f)
+			s.availableFieldNames[dep.Name()] = true
+			s.dependencyOnly = append(s.dependencyOnly, dep)
+			queue = append(queue, dep)
+		}
+	}
+}
+
+// clearDependencyOnlyFields resets the fields dumped only as dependencies,
+// so fields hidden by `Only` or `Exclude` never leak into the output.
+func (s *schema) clearDependencyOnlyFields() {
+	for _, f := range s.dependencyOnly {
+		if err := f.Zero(); err != nil {
+			logger.Warnf("[portal.schema] failed to clear field '%s': %s", f, err)
+		}
+		s.availableFieldNames[f.Name()] = false
+	}
+	s.dependencyOnly = nil
+}
+
+// splitFields splits fields into sync and async ones.
+func splitFields(fields []*schemaField, disableConcurrency bool) (syncFields, asyncFields []*schemaField) {
+	for _, f := range fields {
+		if !disableConcurrency && f.async() {
+			asyncFields = append(asyncFields, f)
+		} else {
+			syncFields = append(syncFields, f)
+		}
+	}
+	return
+}
+
 func (s *schema) innerStruct() *structs.Struct {
 	return s.schemaStruct
 }
 
 func (s *schema) fieldValueFromSrc(ctx context.Context, field *schemaField, v interface{}, noCache bool) (val interface{}, err error) {
+	defer recoverFieldPanic(ctx, field, &err)
+
 	if isNil(v) || !structs.IsStruct(v) {
 		return nil, fmt.Errorf("failed to get value for field %s, empty input data %v", field, v)
 	}
@@ -159,31 +333,58 @@ func (s *schema) fieldValueFromSrc(ctx context.Context, field *schemaField, v in
 
 		var ret interface{}
 		var err error
-		disableCache := noCache || field.isCacheDisabled()
-		if disableCache {
+		var cacheKey *cacheKey
+		cacheOpt := field.cacheOption(noCache)
+		if cacheOpt == nil {
 			ret, err = invokeMethodOfAnyType(ctx, s.rawValue, m, v)
 		} else {
-			cacheKey := genCacheKey(ctx, s.rawValue, v, m)
+			cacheKey = genCacheKey(ctx, s.rawValue, v, m, cacheOpt)
 			ret, err = invokeMethodOfAnyTypeWithCache(ctx, s.rawValue, m, s.cacheGroup, cacheKey, v)
 		}
 
 		if err != nil {
-			return nil, fmt.Errorf("failed to get value: %s", err)
+			return nil, errors.Wrap(err, "failed to get value")
 		}
 		if len(attrs) > 0 {
-			return nestedValue(ctx, ret, attrs, nil, !disableCache)
+			if cacheOpt == nil {
+				return nestedValue(ctx, ret, attrs, nil, nil)
+			}
+			return nestedValue(ctx, ret, attrs, s.cacheGroup, cacheOpt.withParent(cacheKey))
 		}
 		return ret, nil
 	} else if field.hasChainingAttrs() {
-		disableCache := noCache || field.isCacheDisabled()
-		return nestedValue(ctx, v, field.chainingAttrs(), s.cacheGroup, !disableCache)
+		return nestedValue(ctx, v, field.chainingAttrs(), s.cacheGroup, field.cacheOption(noCache))
 	} else {
-		return nestedValue(ctx, v, []string{field.Name()}, nil, false)
+		return nestedValue(ctx, v, []string{field.Name()}, nil, nil)
 	}
 
 	return
 }
 
+// fieldSelection selects fields of a schema to dump.
+type fieldSelection struct {
+	only    []string
+	exclude []string
+	// none selects no fields, e.g. the runtime filter and the tag settings
+	// have nothing in common.
+	none bool
+}
+
+// selectFields applies sel to the schema, nil selects all fields.
+func (s *schema) selectFields(sel *fieldSelection) {
+	if sel == nil {
+		return
+	}
+	if sel.none {
+		for k := range s.availableFieldNames {
+			s.availableFieldNames[k] = false
+		}
+		return
+	}
+	s.setOnlyFields(sel.only...)
+	s.setExcludeFields(sel.exclude...)
+}
+
 func (s *schema) setOnlyFields(fieldNames ...string) {
 	if len(fieldNames) == 0 {
 		return
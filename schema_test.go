@@ -106,3 +106,78 @@ func TestSchema_NameWithParent(t *testing.T) {
 	assert.Equal(t, s2.nameWithParents(), "SchoolSchema.PersonSchema")
 	assert.Equal(t, s3.nameWithParents(), "SchoolSchema.PersonSchema.UserSchema2")
 }
+
+type DependentSchema struct {
+	FullName  string `json:"full_name" portal:"meth:GetFullName;after:first_name,LastName"`
+	Greeting  string `portal:"meth:GetGreeting;after:FullName;async"`
+	FirstName string `json:"first_name" portal:"attr:FirstName;async"`
+	LastName  string `portal:"attr:LastName;async"`
+	ID        int    `portal:"attr:ID"`
+}
+
+func (s *DependentSchema) GetFullName(m *Student) string {
+	return s.FirstName + " " + s.LastName
+}
+
+func (s *DependentSchema) GetGreeting(m *Student) string {
+	return "Hello, " + s.FullName
+}
+
+type CyclicSchema struct {
+	A string `portal:"attr:FirstName;after:C"`
+	B string `portal:"attr:FirstName;after:A"`
+	C string `portal:"attr:FirstName;after:B"`
+	D string `portal:"attr:FirstName"`
+}
+
+type UnknownDependencySchema struct {
+	A string `portal:"attr:FirstName;after:Unknown"`
+}
+
+func stageNames(stages [][]*schemaField) (names [][]string) {
+	for _, fields := range stages {
+		names = append(names, filedNames(fields))
+	}
+	return
+}
+
+func TestSchema_Stages(t *testing.T) {
+	schema := newSchema(&DependentSchema{})
+	stages, err := schema.stages()
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{{"FirstName", "LastName", "ID"}, {"FullName"}, {"Greeting"}}, stageNames(stages))
+
+	// dependencies are dumped even if they're not selected, and cleared after
+	schema = newSchema(&DependentSchema{})
+	schema.setOnlyFields("FullName")
+	stages, err = schema.stages()
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{{"FirstName", "LastName"}, {"FullName"}}, stageNames(stages))
+	schema.schemaStruct.Field("FirstName").Set("Harry")
+	schema.clearDependencyOnlyFields()
+	assert.Equal(t, "", schema.rawValue.(*DependentSchema).FirstName)
+	assert.Equal(t, []string{"FullName"}, filedNames(schema.availableFields()))
+
+	// no need to wait for unavailable fields
+	schema = newSchema(&DependentSchema{})
+	schema.setOnlyFields("ID", "first_name")
+	stages, err = schema.stages()
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{{"FirstName", "ID"}}, stageNames(stages))
+
+	schema = newSchema(&PersonSchema{})
+	stages, err = schema.stages()
+	assert.Nil(t, err)
+	assert.Len(t, stages, 1)
+
+	schema = newSchema(&CyclicSchema{})
+	schema.setOnlyFields("D")
+	_, err = schema.stages()
+	assert.EqualError(t, err, "cyclic field dependencies in 'CyclicSchema': A -> C -> B -> A")
+
+	// plans are computed once per schema type
+	assert.True(t, newSchema(&CyclicSchema{}).plan() == newSchema(&CyclicSchema{}).plan())
+
+	_, err = newSchema(&UnknownDependencySchema{}).stages()
+	assert.EqualError(t, err, "field 'UnknownDependencySchema.A' depends on unknown field 'Unknown'")
+}
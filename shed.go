@@ -0,0 +1,102 @@
+package portal
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+var (
+	shedPolicyCtxKey = contextKey{name: "shed-policy"}
+	shedReportCtxKey = contextKey{name: "shed-report"}
+)
+
+// shedPolicy sheds jobs of optional fields when the executor is busy,
+// or the jobs wait longer than maxWait to start.
+type shedPolicy struct {
+	maxWait time.Duration
+
+	mu     sync.Mutex
+	fields []string
+}
+
+func withShedPolicy(ctx context.Context, p *shedPolicy) context.Context {
+	if p == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, shedPolicyCtxKey, p)
+}
+
+func shedPolicyFromContext(ctx context.Context) *shedPolicy {
+	p, _ := ctx.Value(shedPolicyCtxKey).(*shedPolicy)
+	return p
+}
+
+// record reports the path of a shed field.
+func (p *shedPolicy) record(field string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fields = append(p.fields, field)
+}
+
+func (p *shedPolicy) shedFields() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.fields...)
+}
+
+type shedReport struct {
+	mu     sync.Mutex
+	fields []string
+}
+
+func (r *shedReport) add(fields []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fields = append(r.fields, fields...)
+}
+
+func (r *shedReport) shedFields() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.fields...)
+}
+
+func shedReportFromContext(ctx context.Context) *shedReport {
+	r, _ := ctx.Value(shedReportCtxKey).(*shedReport)
+	return r
+}
+
+// WithShedReport returns a copy of ctx collecting the paths of fields shed by
+// dumps performed with it, which are returned by report.
+// Example:
+// ```
+// ctx, report := portal.WithShedReport(r.Context())
+// chell.DumpWithContext(ctx, &dst, &src)
+// log.Println(report())
+// ```
+func WithShedReport(ctx context.Context) (_ context.Context, report func() []string) {
+	r := &shedReport{}
+	return context.WithValue(ctx, shedReportCtxKey, r), r.shedFields
+}
+
+// optionalPayload is implemented by payloads of jobs which can be shed.
+type optionalPayload interface {
+	optional() bool
+}
+
+// shouldShed reports whether the job is optional and under pressure.
+func (req *jobRequest) shouldShed() bool {
+	if req.submittedAt.IsZero() {
+		// shedding is disabled
+		return false
+	}
+	if p, ok := req.payload.(optionalPayload); !ok || !p.optional() {
+		return false
+	}
+	if req.busy {
+		return true
+	}
+	maxWait := shedPolicyFromContext(req.ctx).maxWait
+	return maxWait > 0 && time.Since(req.submittedAt) > maxWait
+}
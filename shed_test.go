@@ -0,0 +1,130 @@
+package portal
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type busyExecutor struct{}
+
+func (busyExecutor) Submit(task func()) error {
+	return errors.WithStack(ErrExecutorBusy)
+}
+
+type OptionalSchema struct {
+	Name   string `portal:"attr:FirstName;async"`
+	Title  string `portal:"meth:GetTitle;async;optional;default:none"`
+	Avatar string `portal:"meth:GetTitle;async;optional"`
+	Sync   string `portal:"meth:GetTitle;optional"`
+}
+
+func (s *OptionalSchema) GetTitle(m *Student) string {
+	time.Sleep(20 * time.Millisecond)
+	return m.LastName
+}
+
+func TestShedOptionalFields(t *testing.T) {
+	student := &Student{ID: 1, FirstName: "Harry", LastName: "Potter"}
+
+	var shed []string
+	var dst OptionalSchema
+	assert.Nil(t, Dump(&dst, student, WithExecutor(busyExecutor{}), ShedOptionalFields(0, &shed), DisableCache()))
+	assert.Equal(t, OptionalSchema{Name: "Harry", Title: "none", Sync: "Potter"}, dst)
+	assert.Equal(t, []string{"OptionalSchema.Title", "OptionalSchema.Avatar"}, shed)
+
+	// not shed without the option
+	dst = OptionalSchema{}
+	assert.Nil(t, Dump(&dst, student, WithExecutor(busyExecutor{}), DisableCache()))
+	assert.Equal(t, OptionalSchema{Name: "Harry", Title: "Potter", Avatar: "Potter", Sync: "Potter"}, dst)
+
+	// not shed without pressure
+	dst = OptionalSchema{}
+	shed = nil
+	assert.Nil(t, Dump(&dst, student, ShedOptionalFields(time.Second, &shed), DisableCache()))
+	assert.Equal(t, OptionalSchema{Name: "Harry", Title: "Potter", Avatar: "Potter", Sync: "Potter"}, dst)
+	assert.Empty(t, shed)
+}
+
+func TestShedOptionalFields_SharedChell(t *testing.T) {
+	var shed []string
+	chell, err := New(WithExecutor(busyExecutor{}), ShedOptionalFields(0, &shed), DisableCache())
+	assert.Nil(t, err)
+
+	const n = 50
+	var wg sync.WaitGroup
+	reports := make([][]string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, report := WithShedReport(context.TODO())
+			var dst OptionalSchema
+			assert.Nil(t, chell.DumpWithContext(ctx, &dst, &Student{ID: i, FirstName: "Harry"}))
+			reports[i] = report()
+		}(i)
+	}
+	wg.Wait()
+
+	// each dump gets its own report, and the shared one collects all of them.
+	for _, report := range reports {
+		assert.Equal(t, []string{"OptionalSchema.Title", "OptionalSchema.Avatar"}, report)
+	}
+	assert.Len(t, shed, 2*n)
+}
+
+// queueExecutor runs tasks one by one in a goroutine.
+type queueExecutor struct {
+	tasks chan func()
+}
+
+func newQueueExecutor() *queueExecutor {
+	e := &queueExecutor{tasks: make(chan func(), 10)}
+	go func() {
+		for task := range e.tasks {
+			task()
+		}
+	}()
+	return e
+}
+
+func (e *queueExecutor) Submit(task func()) error {
+	e.tasks <- task
+	return nil
+}
+
+func TestShedOptionalFields_MaxWait(t *testing.T) {
+	student := &Student{ID: 1, FirstName: "Harry", LastName: "Potter"}
+	executor := newQueueExecutor()
+	defer close(executor.tasks)
+
+	// the job of Avatar waits for the job of Title in the queue.
+	var shed []string
+	var dst OptionalSchema
+	assert.Nil(t, Dump(&dst, student, WithExecutor(executor), ShedOptionalFields(10*time.Millisecond, &shed), DisableCache()))
+	assert.Equal(t, OptionalSchema{Name: "Harry", Title: "Potter", Sync: "Potter"}, dst)
+	assert.Equal(t, []string{"OptionalSchema.Avatar"}, shed)
+}
+
+func TestPool_Shed(t *testing.T) {
+	pool, err := NewPool(1)
+	assert.Nil(t, err)
+	defer pool.Close()
+
+	// occupy the only worker
+	m := newBlockingModel()
+	errChan := dumpInBackground(m, WithWorkerPool(pool))
+
+	var dst OptionalSchema
+	assert.Nil(t, Dump(&dst, &Student{FirstName: "Harry"}, WithWorkerPool(pool), ShedOptionalFields(0, nil), DisableCache()))
+	assert.Equal(t, "none", dst.Title)
+	assert.Equal(t, uint64(2), pool.Stats().Shed)
+
+	close(m.release)
+	assert.Nil(t, <-errChan)
+	assert.Equal(t, pool.Stats().Submitted, pool.Stats().Completed)
+}
@@ -0,0 +1,97 @@
+package portal
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrShutdown is returned when dumping after `Shutdown` is called.
+var ErrShutdown = errors.New("portal is shut down")
+
+// runningDumps tracks the dumps in progress, for `Shutdown` to wait for.
+var runningDumps = newDumpTracker()
+
+type dumpTracker struct {
+	mu      sync.Mutex
+	closed  bool
+	running int
+	// drained is closed when no dump is running after the tracker is closed.
+	drained chan struct{}
+}
+
+func newDumpTracker() *dumpTracker {
+	return &dumpTracker{drained: make(chan struct{})}
+}
+
+// enter starts a dump, it returns false if the tracker is closed.
+func (t *dumpTracker) enter() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return false
+	}
+	t.running++
+	return true
+}
+
+// count returns the number of running dumps.
+func (t *dumpTracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.running
+}
+
+func (t *dumpTracker) exit() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.running--
+	if t.closed && t.running == 0 {
+		close(t.drained)
+	}
+}
+
+// close stops accepting dumps, the returned channel is closed once
+// the running dumps are done.
+func (t *dumpTracker) close() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.closed {
+		t.closed = true
+		if t.running == 0 {
+			close(t.drained)
+		}
+	}
+	return t.drained
+}
+
+// Shutdown gracefully shuts portal down: new dumps fail with ErrShutdown, and it
+// waits for the running dumps until ctx is done, then releases the global worker pool.
+// It returns the number of dumps still running when ctx is done, along with ctx.Err(),
+// whether they're running sync fields or waiting for jobs of any executor.
+// Worker pools created by `NewPool` are not affected, shut them down by `Pool.Shutdown`.
+// Example:
+// ```
+// ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// defer cancel()
+// if abandoned, err := portal.Shutdown(ctx); err != nil {
+// log.Printf("%d dumps abandoned: %s", abandoned, err)
+// }
+// ```
+func Shutdown(ctx context.Context) (abandoned int, err error) {
+	logger.Debugf("[portal.shutdown] shutting down")
+	select {
+	case <-runningDumps.close():
+		defaultPool.Close()
+		return 0, nil
+	case <-ctx.Done():
+		abandoned = runningDumps.count()
+		logger.Warnf("[portal.shutdown] %d dumps abandoned: %s", abandoned, ctx.Err())
+		defaultPool.Close()
+		return abandoned, errors.WithStack(ctx.Err())
+	}
+}
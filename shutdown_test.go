@@ -0,0 +1,128 @@
+package portal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type blockingModel struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlockingModel() *blockingModel {
+	return &blockingModel{started: make(chan struct{}), release: make(chan struct{})}
+}
+
+type BlockingSchema struct {
+	Name  string `portal:"meth:GetName;async"`
+	Title string `portal:"const:title"`
+}
+
+func (s *BlockingSchema) GetName(m *blockingModel) string {
+	close(m.started)
+	<-m.release
+	return "name"
+}
+
+// resetShutdown restores the global states changed by Shutdown.
+func resetShutdown() {
+	runningDumps = newDumpTracker()
+	defaultPool, _ = NewPool(maxWorkerPoolSize)
+}
+
+func dumpInBackground(m *blockingModel, opts ...option) <-chan error {
+	errChan := make(chan error, 1)
+	go func() {
+		var dst BlockingSchema
+		errChan <- Dump(&dst, m, append(opts, DisableCache())...)
+	}()
+	<-m.started
+	return errChan
+}
+
+func TestShutdown(t *testing.T) {
+	defer resetShutdown()
+
+	m := newBlockingModel()
+	errChan := dumpInBackground(m)
+	time.AfterFunc(20*time.Millisecond, func() { close(m.release) })
+
+	abandoned, err := Shutdown(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, abandoned)
+	assert.Nil(t, <-errChan)
+
+	var dst BlockingSchema
+	err = Dump(&dst, newBlockingModel())
+	assert.Equal(t, ErrShutdown, errors.Cause(err))
+}
+
+func TestShutdown_Timeout(t *testing.T) {
+	defer resetShutdown()
+
+	m := newBlockingModel()
+	errChan := dumpInBackground(m)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	abandoned, err := Shutdown(ctx)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	assert.Equal(t, 1, abandoned)
+
+	close(m.release)
+	<-errChan
+}
+
+type SyncBlockingSchema struct {
+	Name string `portal:"meth:GetName"`
+}
+
+func (s *SyncBlockingSchema) GetName(m *blockingModel) string {
+	close(m.started)
+	<-m.release
+	return "name"
+}
+
+func TestShutdown_TimeoutSyncDump(t *testing.T) {
+	defer resetShutdown()
+
+	m := newBlockingModel()
+	errChan := make(chan error, 1)
+	go func() {
+		var dst SyncBlockingSchema
+		errChan <- Dump(&dst, m, DisableCache())
+	}()
+	<-m.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	abandoned, err := Shutdown(ctx)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	assert.Equal(t, 1, abandoned)
+
+	close(m.release)
+	<-errChan
+}
+
+func TestPool_Shutdown(t *testing.T) {
+	pool, err := NewPool(10)
+	assert.Nil(t, err)
+
+	m := newBlockingModel()
+	errChan := dumpInBackground(m, WithWorkerPool(pool))
+	time.AfterFunc(20*time.Millisecond, func() { close(m.release) })
+
+	abandoned, err := pool.Shutdown(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, abandoned)
+	assert.Nil(t, <-errChan)
+
+	var dst BlockingSchema
+	err = Dump(&dst, newBlockingModel(), WithWorkerPool(pool))
+	assert.Equal(t, ErrPoolClosed, errors.Cause(err))
+}
@@ -0,0 +1,299 @@
+package portal
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TieredCache combines an in-process Cacher with a remote one (e.g. Redis)
+// shared by service replicas. Values are written through to both tiers,
+// and read through from the remote tier on local misses.
+// The remote tier stores values encoded by the codec as []byte, prefixed by
+// the expiration time, so values read through keep the remote TTL in the
+// local tier. It's best effort: failures of the remote tier are logged and
+// treated as misses.
+type TieredCache struct {
+	local    Cacher
+	remote   Cacher
+	codec    Codec
+	localTTL time.Duration
+}
+
+type tieredOption func(c *TieredCache)
+
+// TieredLocalTTL limits the TTL of values in the local tier, so that
+// values updated by other replicas are picked up eventually.
+func TieredLocalTTL(ttl time.Duration) tieredOption {
+	return func(c *TieredCache) {
+		c.localTTL = ttl
+	}
+}
+
+// NewTieredCache creates a TieredCache. The codec defaults to JSONCodec if nil.
+// Example:
+// ```
+// portal.RegisterCacheType(&model.UserModel{})
+// cache := portal.NewTieredCache(portal.NewLRUCache(10000, 0), redisCache, portal.GobCodec, portal.TieredLocalTTL(time.Minute))
+// portal.SetCache(cache)
+// ```
+func NewTieredCache(local, remote Cacher, codec Codec, opts ...tieredOption) *TieredCache {
+	if codec == nil {
+		codec = JSONCodec
+	}
+
+	c := &TieredCache{local: local, remote: remote, codec: codec}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+var _ Cacher = (*TieredCache)(nil)
+var _ TTLSetter = (*TieredCache)(nil)
+var _ Deleter = (*TieredCache)(nil)
+var _ BatchCacher = (*TieredCache)(nil)
+
+func (c *TieredCache) Set(ctx context.Context, key, value interface{}) error {
+	return c.SetWithTTL(ctx, key, value, 0)
+}
+
+// SetWithTTL writes value to both tiers, the ttl is passed to tiers implementing TTLSetter.
+func (c *TieredCache) SetWithTTL(ctx context.Context, key, value interface{}, ttl time.Duration) error {
+	if err := c.setLocal(ctx, key, value, ttl); err != nil {
+		return errors.WithStack(err)
+	}
+
+	data, err := c.encode(value, ttl)
+	if err != nil {
+		logger.Warnf("[portal.cache] failed to encode value of '%v': %s", key, err)
+		return nil
+	}
+	if err := setWithTTL(ctx, c.remote, key, data, ttl); err != nil {
+		logger.Warnf("[portal.cache] failed to set remote cache '%v': %s", key, err)
+	}
+	return nil
+}
+
+func (c *TieredCache) Get(ctx context.Context, key interface{}) (interface{}, error) {
+	if v, err := c.local.Get(ctx, key); err == nil {
+		return v, nil
+	}
+
+	raw, err := c.remote.Get(ctx, key)
+	if err != nil {
+		if _, ok := err.(*ErrNil); !ok {
+			logger.Warnf("[portal.cache] failed to get remote cache '%v': %s", key, err)
+		}
+		return nil, &ErrNil{}
+	}
+
+	return c.decode(ctx, key, raw)
+}
+
+// GetMulti gets values from the local tier, and the missing ones from the remote
+// tier with one call if it implements BatchCacher.
+func (c *TieredCache) GetMulti(ctx context.Context, keys []interface{}) (map[interface{}]interface{}, error) {
+	result := make(map[interface{}]interface{}, len(keys))
+	var missing []interface{}
+	for _, key := range keys {
+		if v, err := c.local.Get(ctx, key); err == nil {
+			result[key] = v
+		} else {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) == 0 {
+		return result, nil
+	}
+
+	remote, ok := c.remote.(BatchCacher)
+	if !ok {
+		for _, key := range missing {
+			if v, err := c.Get(ctx, key); err == nil {
+				result[key] = v
+			}
+		}
+		return result, nil
+	}
+
+	values, err := remote.GetMulti(ctx, missing)
+	if err != nil {
+		logger.Warnf("[portal.cache] failed to get %d keys from remote cache: %s", len(missing), err)
+		return result, nil
+	}
+	for key, raw := range values {
+		if v, err := c.decode(ctx, key, raw); err == nil {
+			result[key] = v
+		}
+	}
+	return result, nil
+}
+
+// SetMulti writes the items to both tiers, the remote tier is set with one call
+// if it implements BatchCacher.
+func (c *TieredCache) SetMulti(ctx context.Context, items map[interface{}]interface{}, ttl time.Duration) error {
+	remote, ok := c.remote.(BatchCacher)
+	if !ok {
+		for key, value := range items {
+			if err := c.SetWithTTL(ctx, key, value, ttl); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	encoded := make(map[interface{}]interface{}, len(items))
+	for key, value := range items {
+		if err := c.setLocal(ctx, key, value, ttl); err != nil {
+			return errors.WithStack(err)
+		}
+
+		data, err := c.encode(value, ttl)
+		if err != nil {
+			logger.Warnf("[portal.cache] failed to encode value of '%v': %s", key, err)
+			continue
+		}
+		encoded[key] = data
+	}
+
+	if err := remote.SetMulti(ctx, encoded, ttl); err != nil {
+		logger.Warnf("[portal.cache] failed to set %d keys to remote cache: %s", len(encoded), err)
+	}
+	return nil
+}
+
+// tieredHeaderSize is the size of the expiration time prefixed to remote values.
+const tieredHeaderSize = 8
+
+// encode encodes the value for the remote tier, prefixed by the expiration
+// time in unix nanoseconds, zero means it never expires.
+func (c *TieredCache) encode(value interface{}, ttl time.Duration) ([]byte, error) {
+	data, err := c.codec.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var expireAt int64
+	if ttl > 0 {
+		expireAt = time.Now().Add(ttl).UnixNano()
+	}
+	buf := make([]byte, tieredHeaderSize+len(data))
+	binary.BigEndian.PutUint64(buf, uint64(expireAt))
+	copy(buf[tieredHeaderSize:], data)
+	return buf, nil
+}
+
+// decode decodes the raw value got from the remote tier, and sets it to the
+// local tier with the remaining TTL of the remote one.
+func (c *TieredCache) decode(ctx context.Context, key, raw interface{}) (interface{}, error) {
+	data, ok := raw.([]byte)
+	if !ok || len(data) < tieredHeaderSize {
+		logger.Warnf("[portal.cache] unexpected value type '%T' of remote cache '%v'", raw, key)
+		return nil, &ErrNil{}
+	}
+
+	var ttl time.Duration
+	if expireAt := int64(binary.BigEndian.Uint64(data)); expireAt > 0 {
+		ttl = time.Until(time.Unix(0, expireAt))
+		if ttl <= 0 {
+			return nil, &ErrNil{}
+		}
+	}
+
+	v, err := c.codec.Unmarshal(data[tieredHeaderSize:])
+	if err != nil {
+		logger.Warnf("[portal.cache] failed to decode value of '%v': %s", key, err)
+		return nil, &ErrNil{}
+	}
+
+	if err := c.setLocal(ctx, key, v, ttl); err != nil {
+		logger.Warnf("[portal.cache] failed to set local cache '%v': %s", key, err)
+	}
+	return v, nil
+}
+
+// Delete removes the keys from both tiers, both of them must implement Deleter.
+func (c *TieredCache) Delete(ctx context.Context, keys ...interface{}) error {
+	if err := deleteKeys(ctx, c.local, keys...); err != nil {
+		return err
+	}
+	return deleteKeys(ctx, c.remote, keys...)
+}
+
+func (c *TieredCache) setLocal(ctx context.Context, key, value interface{}, ttl time.Duration) error {
+	if c.localTTL > 0 && (ttl <= 0 || ttl > c.localTTL) {
+		ttl = c.localTTL
+	}
+	return setWithTTL(ctx, c.local, key, value, ttl)
+}
+
+// ByteStore is an in-memory Cacher of []byte values, which stands in for
+// a remote store in tests. Values are copied like they are sent over network.
+type ByteStore struct {
+	m *MapCache
+}
+
+// NewByteStore creates an empty ByteStore.
+func NewByteStore() *ByteStore {
+	return &ByteStore{m: newMapCache()}
+}
+
+var _ Cacher = (*ByteStore)(nil)
+var _ TTLSetter = (*ByteStore)(nil)
+var _ Deleter = (*ByteStore)(nil)
+var _ BatchCacher = (*ByteStore)(nil)
+
+func (s *ByteStore) Set(ctx context.Context, key, value interface{}) error {
+	return s.SetWithTTL(ctx, key, value, 0)
+}
+
+// SetWithTTL sets value with a ttl, the entry never expires if ttl is not positive.
+func (s *ByteStore) SetWithTTL(ctx context.Context, key, value interface{}, ttl time.Duration) error {
+	data, ok := value.([]byte)
+	if !ok {
+		return errors.Errorf("ByteStore only stores []byte, got '%T'", value)
+	}
+	return s.m.SetWithTTL(ctx, key, append([]byte(nil), data...), ttl)
+}
+
+func (s *ByteStore) Get(ctx context.Context, key interface{}) (interface{}, error) {
+	v, err := s.m.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), v.([]byte)...), nil
+}
+
+// GetMulti returns the values of found keys.
+func (s *ByteStore) GetMulti(ctx context.Context, keys []interface{}) (map[interface{}]interface{}, error) {
+	result := make(map[interface{}]interface{}, len(keys))
+	for _, key := range keys {
+		if v, err := s.Get(ctx, key); err == nil {
+			result[key] = v
+		}
+	}
+	return result, nil
+}
+
+// SetMulti sets the items with a ttl.
+func (s *ByteStore) SetMulti(ctx context.Context, items map[interface{}]interface{}, ttl time.Duration) error {
+	for key, value := range items {
+		if err := s.SetWithTTL(ctx, key, value, ttl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes the keys.
+func (s *ByteStore) Delete(ctx context.Context, keys ...interface{}) error {
+	return s.m.Delete(ctx, keys...)
+}
+
+// Len returns the number of entries, including expired ones not yet removed.
+func (s *ByteStore) Len() int {
+	return s.m.Len()
+}
@@ -0,0 +1,141 @@
+package portal
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTieredCache(t *testing.T) {
+	ctx := context.TODO()
+	RegisterCacheType(&codecModel{})
+
+	remote := NewByteStore()
+	replica1 := NewTieredCache(newMapCache(), remote, JSONCodec)
+	replica2 := NewTieredCache(newMapCache(), remote, GobCodec)
+	replica3 := NewTieredCache(newMapCache(), remote, nil)
+
+	// write through
+	require.Nil(t, replica1.Set(ctx, "k", &codecModel{ID: 1}))
+	assert.Equal(t, 1, remote.Len())
+	v, err := replica1.local.Get(ctx, "k")
+	require.Nil(t, err)
+	assert.Equal(t, &codecModel{ID: 1}, v)
+
+	// read through
+	v, err = replica3.Get(ctx, "k")
+	require.Nil(t, err)
+	assert.Equal(t, &codecModel{ID: 1}, v)
+	v, err = replica3.local.Get(ctx, "k")
+	require.Nil(t, err)
+	assert.Equal(t, &codecModel{ID: 1}, v)
+
+	// decode failure is a miss
+	_, err = replica2.Get(ctx, "k")
+	assert.IsType(t, &ErrNil{}, err)
+
+	_, err = replica1.Get(ctx, "missing")
+	assert.IsType(t, &ErrNil{}, err)
+}
+
+func TestTieredCache_TTL(t *testing.T) {
+	ctx := context.TODO()
+	remote := NewByteStore()
+	c := NewTieredCache(newMapCache(), remote, JSONCodec, TieredLocalTTL(20*time.Millisecond))
+
+	require.Nil(t, c.SetWithTTL(ctx, "short", "a", 10*time.Millisecond))
+	require.Nil(t, c.Set(ctx, "long", "b"))
+	time.Sleep(30 * time.Millisecond)
+
+	_, err := c.Get(ctx, "short")
+	assert.IsType(t, &ErrNil{}, err)
+
+	// local expired, read through from remote
+	_, err = c.local.Get(ctx, "long")
+	assert.IsType(t, &ErrNil{}, err)
+	v, err := c.Get(ctx, "long")
+	require.Nil(t, err)
+	assert.Equal(t, "b", v)
+}
+
+func TestTieredCache_ReadThroughKeepsRemoteTTL(t *testing.T) {
+	ctx := context.TODO()
+	remote := NewByteStore()
+	writer := NewTieredCache(newMapCache(), remote, JSONCodec)
+	reader := NewTieredCache(newMapCache(), remote, JSONCodec)
+
+	require.Nil(t, writer.SetWithTTL(ctx, "k", "v", 20*time.Millisecond))
+	v, err := reader.Get(ctx, "k")
+	require.Nil(t, err)
+	assert.Equal(t, "v", v)
+	_, err = reader.local.Get(ctx, "k")
+	require.Nil(t, err)
+
+	time.Sleep(30 * time.Millisecond)
+	_, err = reader.local.Get(ctx, "k")
+	assert.IsType(t, &ErrNil{}, err)
+	_, err = reader.Get(ctx, "k")
+	assert.IsType(t, &ErrNil{}, err)
+}
+
+type failingCache struct{}
+
+func (failingCache) Set(ctx context.Context, key, value interface{}) error {
+	return errors.New("connection refused")
+}
+
+func (failingCache) Get(ctx context.Context, key interface{}) (interface{}, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestTieredCache_RemoteFailure(t *testing.T) {
+	ctx := context.TODO()
+	c := NewTieredCache(newMapCache(), failingCache{}, JSONCodec)
+
+	assert.Nil(t, c.Set(ctx, "k", "v"))
+	v, err := c.Get(ctx, "k")
+	require.Nil(t, err)
+	assert.Equal(t, "v", v)
+
+	_, err = c.Get(ctx, "missing")
+	assert.IsType(t, &ErrNil{}, err)
+
+	// values which cannot be encoded stay local
+	assert.Nil(t, c.Set(ctx, "chan", make(chan int)))
+}
+
+func TestByteStore(t *testing.T) {
+	ctx := context.TODO()
+	s := NewByteStore()
+
+	assert.EqualError(t, s.Set(ctx, "k", "v"), "ByteStore only stores []byte, got 'string'")
+
+	data := []byte("v")
+	require.Nil(t, s.Set(ctx, "k", data))
+	data[0] = 'x'
+	v, err := s.Get(ctx, "k")
+	require.Nil(t, err)
+	assert.Equal(t, []byte("v"), v)
+}
+
+func TestTieredCache_SharedAcrossReplicas(t *testing.T) {
+	remote := NewByteStore()
+
+	var calls int32
+	for i := 0; i < 3; i++ {
+		// each dump runs on a new replica
+		var dst CountedSchema
+		c := NewTieredCache(newMapCache(), remote, GobCodec)
+		assert.Nil(t, Dump(&dst, &countedModel{ID: 1, calls: &calls}, UseCache(c)))
+		assert.Equal(t, CountedSchema{Name: "name_1", Title: "title_1"}, dst)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	assert.Equal(t, 2, remote.Len())
+	_, err := remote.Get(context.TODO(), "portal:github.com/ifaceless/portal.CountedSchema#GetName#countedModel:1")
+	assert.Nil(t, err)
+}
@@ -8,7 +8,8 @@ import (
 	"github.com/pkg/errors"
 )
 
-func nestedValue(ctx context.Context, any interface{}, chainingAttrs []string, cg *cacheGroup, enableCache bool) (interface{}, error) {
+// nestedValue gets value by chaining attributes, results are cached if cacheOpt is not nil.
+func nestedValue(ctx context.Context, any interface{}, chainingAttrs []string, cg *cacheGroup, cacheOpt *cacheOption) (interface{}, error) {
 	if len(chainingAttrs) == 0 {
 		return any, nil
 	}
@@ -25,7 +26,7 @@ func nestedValue(ctx context.Context, any interface{}, chainingAttrs []string, c
 		if reflect.Indirect(rv).Kind() == reflect.Struct {
 			field := reflect.Indirect(rv).FieldByName(attr)
 			if field.IsValid() {
-				return nestedValue(ctx, field.Interface(), chainingAttrs[1:], nil, false)
+				return nestedValue(ctx, field.Interface(), chainingAttrs[1:], nil, nil)
 			}
 		}
 
@@ -36,9 +37,11 @@ func nestedValue(ctx context.Context, any interface{}, chainingAttrs []string, c
 	}
 
 	var ret interface{}
-	if enableCache {
-		cacheKey := genCacheKey(ctx, any, any, attr)
+	var nextCacheOpt *cacheOption
+	if cacheOpt != nil {
+		cacheKey := genCacheKey(ctx, any, any, attr, cacheOpt)
 		ret, err = invokeWithCache(ctx, rv, meth, attr, cg, cacheKey)
+		nextCacheOpt = cacheOpt.withParent(cacheKey)
 	} else {
 		ret, err = invoke(ctx, rv, meth, attr)
 	}
@@ -46,7 +49,7 @@ func nestedValue(ctx context.Context, any interface{}, chainingAttrs []string, c
 	if err != nil {
 		return nil, err
 	}
-	return nestedValue(ctx, ret, chainingAttrs[1:], cg, enableCache)
+	return nestedValue(ctx, ret, chainingAttrs[1:], cg, nextCacheOpt)
 }
 
 // invokeMethodOfAnyType calls the specified method of a value and return results.
@@ -66,7 +69,7 @@ func invokeMethodOfAnyType(ctx context.Context, any interface{}, name string, ar
 	return invokeMethodOfReflectedValue(ctx, reflect.ValueOf(any), name, args...)
 }
 
-func invokeMethodOfAnyTypeWithCache(ctx context.Context, any interface{}, name string, cg *cacheGroup, cacheKey *string, args ...interface{}) (interface{}, error) {
+func invokeMethodOfAnyTypeWithCache(ctx context.Context, any interface{}, name string, cg *cacheGroup, cacheKey *cacheKey, args ...interface{}) (interface{}, error) {
 	return invokeMethodOfReflectedValueWithCache(ctx, reflect.ValueOf(any), name, cg, cacheKey, args...)
 }
 
@@ -78,7 +81,7 @@ func invokeMethodOfReflectedValue(ctx context.Context, any reflect.Value, name s
 	return invoke(ctx, any, method, name, args...)
 }
 
-func invokeMethodOfReflectedValueWithCache(ctx context.Context, any reflect.Value, name string, cg *cacheGroup, cacheKey *string, args ...interface{}) (interface{}, error) {
+func invokeMethodOfReflectedValueWithCache(ctx context.Context, any reflect.Value, name string, cg *cacheGroup, cacheKey *cacheKey, args ...interface{}) (interface{}, error) {
 	method, err := findMethod(any, name)
 	if err != nil {
 		return nil, err
@@ -150,26 +153,38 @@ func invoke(ctx context.Context, any reflect.Value, method reflect.Value, method
 	}
 }
 
-func invokeWithCache(ctx context.Context, any reflect.Value, method reflect.Value, methodName string, cg *cacheGroup, cacheKey *string, args ...interface{}) (interface{}, error) {
-	if !cg.valid() || cacheKey == nil {
+func invokeWithCache(ctx context.Context, any reflect.Value, method reflect.Value, methodName string, cg *cacheGroup, cacheKey *cacheKey, args ...interface{}) (interface{}, error) {
+	if cg == nil || !cg.valid(ctx) || cacheKey == nil {
 		ret, err := invoke(ctx, any, method, methodName, args...)
 		return ret, errors.WithStack(err)
 	}
 
 	// singleflight, only one execution under multiple goroutines
-	v, err, _ := cg.g.Do(*cacheKey, func() (interface{}, error) {
-		if ret, err := cg.cache.Get(ctx, *cacheKey); err == nil {
-			return ret, nil
+	v, err, _ := cg.g.Do(cacheKey.key, func() (_ interface{}, err error) {
+		// a panic must not escape, or calls waiting for the key hang forever.
+		defer recoverPanic(&err)
+
+		if ret, err := cg.get(ctx, cacheKey); err == nil {
+			return unwrapNegative(ret)
 		}
 		ret, err := invoke(ctx, any, method, methodName, args...)
-		if err == nil {
-			err = cg.cache.Set(ctx, *cacheKey, ret)
-			if err != nil {
-				return nil, errors.WithStack(err)
+		if err != nil {
+			if e := cg.setNegative(ctx, cacheKey, err); e != nil {
+				logger.Warnf("[portal.cache] failed to cache error of '%s': %s", cacheKey.key, e)
 			}
-			return ret, nil
+			return ret, errors.WithStack(err)
 		}
-		return ret, errors.WithStack(err)
+
+		if isNil(ret) {
+			// nil results are negative results, e.g. a missing relation.
+			err = cg.setNegative(ctx, cacheKey, nil)
+		} else {
+			err = cg.set(ctx, cacheKey, ret)
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return ret, nil
 	})
 
 	return v, err